@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "cached results related commands",
+}
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+}
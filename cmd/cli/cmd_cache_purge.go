@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/cobra"
+)
+
+// Subject the servers listen on to purge their cache
+const subjectCachePurge = "__cachePurge"
+
+var cachePurgeCmd = &cobra.Command{
+	Use:   "purge [subject]",
+	Args:  cobra.ExactArgs(1),
+	Short: "remove the cached results of the scripts of a subject",
+	Long:  "remove the cached results of the scripts of a subject on all the servers. The subject can be a pattern to purge multiple subjects at once",
+	Run:   cachePurgeCmdRun,
+}
+
+func init() {
+	cacheCmd.AddCommand(cachePurgeCmd)
+}
+
+func cachePurgeCmdRun(cmd *cobra.Command, args []string) {
+	nc, err := nats.Connect(cmd.Flag("natsurl").Value.String())
+	if err != nil {
+		cmd.PrintErrf("failed to connect to NATS: %v\n", err)
+		return
+	}
+	defer nc.Close()
+
+	msg, err := nc.Request(subjectCachePurge, []byte(args[0]), 5*time.Second)
+	if err != nil {
+		cmd.PrintErrf("failed to purge cache: %v\n", err)
+		return
+	}
+
+	rep := new(struct {
+		Error string `json:"error"`
+	})
+	err = json.Unmarshal(msg.Data, rep)
+	if err != nil {
+		cmd.PrintErrf("failed to decode reply: %v\n", err)
+		return
+	}
+	if rep.Error != "" {
+		cmd.PrintErrf("failed to purge cache: %s\n", rep.Error)
+		return
+	}
+
+	cmd.Printf("Cache of %s purged\n", args[0])
+}
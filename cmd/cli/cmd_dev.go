@@ -113,7 +113,7 @@ func devCmdRun(cmd *cobra.Command, args []string) {
 		Executor: cmd.Flag("executor").Value.String(),
 	}
 
-	executors := executor.StartAllExecutors(cmd.Context(), store, plugins, nil)
+	executors := executor.StartAllExecutors(cmd.Context(), store, plugins, nil, executor.LuaOptions{})
 	exec, err := executor.ExecutorByName(m.Executor, executors)
 	if err != nil {
 		cmd.PrintErrf("failed to get executor for message: %v", err)
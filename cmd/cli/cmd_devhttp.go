@@ -53,7 +53,7 @@ func devHttpCmdRun(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	executors := executor.StartAllExecutors(cmd.Context(), store, plugins, nil)
+	executors := executor.StartAllExecutors(cmd.Context(), store, plugins, nil, executor.LuaOptions{})
 	exec, err := executor.ExecutorByName(cmd.Flag("executor").Value.String(), executors)
 	if err != nil {
 		cmd.PrintErrf("failed to get executor for message: %v", err)
@@ -172,7 +172,13 @@ func (p *devHttpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Infof("URL: %s", url)
 
+	headers := make(map[string]string)
+	for k, v := range r.Header {
+		headers[k] = strings.Join(v, ", ")
+	}
+
 	msg := &executor.Message{
+		Headers: headers,
 		Payload: payload,
 		Method:  r.Method,
 		Subject: subject,
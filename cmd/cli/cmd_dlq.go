@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/spf13/cobra"
+
+	"github.com/numkem/msgscript/executor"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+var dlqCmd = &cobra.Command{
+	Use:   "dlq",
+	Short: "dead letters related commands",
+}
+
+func init() {
+	rootCmd.AddCommand(dlqCmd)
+
+	dlqCmd.PersistentFlags().String("dlq", executor.DEFAULT_DEAD_LETTER_PREFIX, "Subject prefix where the server publishes the dead letters")
+	dlqCmd.PersistentFlags().StringP("subject", "s", "", "Only handle the dead letters of this subject (wildcards are allowed)")
+}
+
+type deadLetterEntry struct {
+	Sequence   uint64
+	DeadLetter *executor.DeadLetter
+}
+
+// deadLetterStream connects to NATS and returns the stream holding the dead letters
+func deadLetterStream(cmd *cobra.Command) (*nats.Conn, jetstream.Stream, error) {
+	nc, err := nats.Connect(cmd.Flag("natsurl").Value.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, nil, fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	stream, err := js.Stream(cmd.Context(), executor.DEAD_LETTER_STREAM_NAME)
+	if err != nil {
+		nc.Close()
+		return nil, nil, fmt.Errorf("failed to get stream %s: %w", executor.DEAD_LETTER_STREAM_NAME, err)
+	}
+
+	return nc, stream, nil
+}
+
+// readDeadLetters returns all the dead letters in the stream published for the subject (or pattern).
+// An empty subject returns all of them.
+func readDeadLetters(ctx context.Context, stream jetstream.Stream, prefix, subject string) ([]*deadLetterEntry, error) {
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stream info: %w", err)
+	}
+
+	pattern := executor.DeadLetterSubject(prefix, ">")
+	if subject != "" {
+		pattern = executor.DeadLetterSubject(prefix, subject)
+	}
+
+	var entries []*deadLetterEntry
+	for seq := info.State.FirstSeq; seq <= info.State.LastSeq && info.State.Msgs > 0; seq++ {
+		msg, err := stream.GetMsg(ctx, seq)
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			// Messages that were re-driven are removed from the stream
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get message %d: %w", seq, err)
+		}
+
+		if !msgstore.SubjectMatches(pattern, msg.Subject) {
+			continue
+		}
+
+		dl := new(executor.DeadLetter)
+		err = json.Unmarshal(msg.Data, dl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode dead letter %d: %w", seq, err)
+		}
+
+		entries = append(entries, &deadLetterEntry{Sequence: seq, DeadLetter: dl})
+	}
+
+	return entries, nil
+}
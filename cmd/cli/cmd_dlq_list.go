@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+)
+
+var dlqListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "list the messages that scripts failed to handle",
+	Run:     dlqListCmdRun,
+}
+
+func init() {
+	dlqCmd.AddCommand(dlqListCmd)
+}
+
+func dlqListCmdRun(cmd *cobra.Command, args []string) {
+	nc, stream, err := deadLetterStream(cmd)
+	if err != nil {
+		cmd.PrintErrf("%v\n", err)
+		return
+	}
+	defer nc.Close()
+
+	entries, err := readDeadLetters(cmd.Context(), stream, cmd.Flag("dlq").Value.String(), cmd.Flag("subject").Value.String())
+	if err != nil {
+		cmd.PrintErrf("failed to read dead letters: %v\n", err)
+		return
+	}
+
+	if len(entries) == 0 {
+		cmd.Print("No dead letter\n")
+		return
+	}
+
+	t := table.NewWriter()
+	t.SetOutputMirror(cmd.OutOrStdout())
+	t.SetStyle(table.StyleLight)
+	t.Style().Options.DrawBorder = false
+	t.Style().Options.SeparateRows = false
+	t.Style().Options.SeparateColumns = false
+	t.Style().Options.SeparateHeader = false
+	t.Style().Options.SeparateFooter = false
+
+	t.AppendHeader(table.Row{"ID", "Time", "Subject", "Name", "Attempts", "Error"})
+
+	for _, e := range entries {
+		dl := e.DeadLetter
+		t.AppendRow(table.Row{e.Sequence, dl.Time.Format(time.RFC3339), dl.Subject, dl.Name, dl.Attempts, dl.Error})
+	}
+
+	t.Render()
+}
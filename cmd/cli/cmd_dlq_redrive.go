@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/cobra"
+)
+
+var dlqRedriveCmd = &cobra.Command{
+	Use:   "redrive [id...]",
+	Short: "publish dead letters back to their subject",
+	Long:  "publish dead letters back to their original subject so the scripts handle them again. Re-driven dead letters are removed from the list",
+	Run:   dlqRedriveCmdRun,
+}
+
+func init() {
+	dlqCmd.AddCommand(dlqRedriveCmd)
+
+	dlqRedriveCmd.PersistentFlags().BoolP("all", "a", false, "Re-drive all the dead letters (of the subject if provided)")
+}
+
+func dlqRedriveCmdRun(cmd *cobra.Command, args []string) {
+	all, err := cmd.Flags().GetBool("all")
+	if err != nil {
+		cmd.PrintErrf("failed to get all flag: %v\n", err)
+		return
+	}
+
+	if !all && len(args) == 0 {
+		cmd.PrintErrf("either provide the IDs of the dead letters or use --all\n")
+		return
+	}
+
+	ids := make(map[uint64]bool)
+	for _, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			cmd.PrintErrf("invalid dead letter ID %s: %v\n", arg, err)
+			return
+		}
+		ids[id] = true
+	}
+
+	nc, stream, err := deadLetterStream(cmd)
+	if err != nil {
+		cmd.PrintErrf("%v\n", err)
+		return
+	}
+	defer nc.Close()
+
+	entries, err := readDeadLetters(cmd.Context(), stream, cmd.Flag("dlq").Value.String(), cmd.Flag("subject").Value.String())
+	if err != nil {
+		cmd.PrintErrf("failed to read dead letters: %v\n", err)
+		return
+	}
+
+	var count int
+	for _, e := range entries {
+		if !all && !ids[e.Sequence] {
+			continue
+		}
+
+		// Raw messages are sent back as they were received, along with their headers. Like for a replay, the headers
+		// of the transport of the message aren't sent again.
+		m := replayMessage(e.DeadLetter.Message, nil)
+		msg := nats.NewMsg(m.Subject)
+		msg.Data = m.Payload
+		for k, v := range m.Headers {
+			msg.Header.Set(k, v)
+		}
+		if !m.Raw {
+			msg.Data, err = json.Marshal(m)
+			if err != nil {
+				cmd.PrintErrf("failed to serialize message %d: %v\n", e.Sequence, err)
+				continue
+			}
+		}
+
+		err = nc.PublishMsg(msg)
+		if err != nil {
+			cmd.PrintErrf("failed to publish message %d to %s: %v\n", e.Sequence, m.Subject, err)
+			continue
+		}
+
+		err = stream.DeleteMsg(cmd.Context(), e.Sequence)
+		if err != nil {
+			cmd.PrintErrf("failed to remove dead letter %d: %v\n", e.Sequence, err)
+		}
+
+		count++
+	}
+
+	err = nc.Flush()
+	if err != nil {
+		cmd.PrintErrf("failed to flush messages: %v\n", err)
+		return
+	}
+
+	cmd.Printf("Re-drove %d dead letters\n", count)
+}
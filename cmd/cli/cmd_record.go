@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/numkem/msgscript/executor"
+)
+
+var recordCmd = &cobra.Command{
+	Use:   "record",
+	Short: "record the messages sent to a subject and the replies of the server",
+	Long:  "record the messages sent to a subject (wildcards are allowed) along with their headers and the replies sent by the server, one JSON object per line. Stops on interrupt or once the count is reached",
+	Run:   recordCmdRun,
+}
+
+func init() {
+	rootCmd.AddCommand(recordCmd)
+
+	recordCmd.PersistentFlags().StringP("subject", "s", "", "The subject (or pattern) to record")
+	recordCmd.PersistentFlags().StringP("out", "o", "", "The file to write the recording to, defaults to stdout")
+	recordCmd.PersistentFlags().IntP("count", "c", 0, "Stop after recording this many messages, 0 to record until interrupted")
+	recordCmd.PersistentFlags().Duration("timeout", 10*time.Second, "How long to wait for the reply of a message before recording it without one")
+
+	recordCmd.MarkPersistentFlagRequired("subject")
+}
+
+// recordedReply is the reply the server sent for a recorded message
+type recordedReply struct {
+	Error   string                   `json:"error,omitempty"`
+	Headers nats.Header              `json:"headers,omitempty"`
+	Results []*executor.ScriptResult `json:"script_result"`
+}
+
+// recording is a message received on the recorded subject, written as a line of the recording
+type recording struct {
+	Headers nats.Header       `json:"headers,omitempty"`
+	Message *executor.Message `json:"message"`
+	Reply   *recordedReply    `json:"reply,omitempty"`
+	Subject string            `json:"subject"`
+	Time    time.Time         `json:"time"`
+}
+
+// recorder writes the recorded messages once their reply is received
+type recorder struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	pending map[string]*recording
+	count   int
+	done    chan struct{}
+	max     int
+}
+
+func (r *recorder) write(rec *recording) {
+	err := r.enc.Encode(rec)
+	if err != nil {
+		log.Errorf("failed to write message received on %s: %v", rec.Subject, err)
+		return
+	}
+
+	r.count++
+	if r.max > 0 && r.count == r.max {
+		close(r.done)
+	}
+}
+
+func (r *recorder) onMessage(msg *nats.Msg, timeout time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.max > 0 && r.count >= r.max {
+		return
+	}
+
+	rec := &recording{
+		Headers: msg.Header,
+		Message: executor.ParseMessage(msg.Subject, msg.Data, msg.Header),
+		Subject: msg.Subject,
+		Time:    time.Now(),
+	}
+
+	// Messages nobody waits a reply for are recorded right away
+	if msg.Reply == "" {
+		r.write(rec)
+		return
+	}
+
+	r.pending[msg.Reply] = rec
+	time.AfterFunc(timeout, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.flush(msg.Reply)
+	})
+}
+
+func (r *recorder) onReply(msg *nats.Msg) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, found := r.pending[msg.Subject]
+	if !found {
+		return
+	}
+
+	rep := &recordedReply{Headers: msg.Header}
+	err := json.Unmarshal(msg.Data, rep)
+	if err != nil {
+		rep.Error = string(msg.Data)
+	}
+	rec.Reply = rep
+
+	r.flush(msg.Subject)
+}
+
+// flush writes the message waiting for the reply, if it wasn't already
+func (r *recorder) flush(reply string) {
+	rec, found := r.pending[reply]
+	if !found {
+		return
+	}
+	delete(r.pending, reply)
+
+	if r.max > 0 && r.count >= r.max {
+		return
+	}
+
+	r.write(rec)
+}
+
+func recordCmdRun(cmd *cobra.Command, args []string) {
+	count, err := cmd.Flags().GetInt("count")
+	if err != nil {
+		cmd.PrintErrf("failed to get count flag: %v\n", err)
+		return
+	}
+
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		cmd.PrintErrf("failed to get timeout flag: %v\n", err)
+		return
+	}
+
+	var out io.Writer = cmd.OutOrStdout()
+	if path := cmd.Flag("out").Value.String(); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			cmd.PrintErrf("failed to create %s: %v\n", path, err)
+			return
+		}
+		defer f.Close()
+
+		out = f
+	}
+
+	nc, err := nats.Connect(cmd.Flag("natsurl").Value.String())
+	if err != nil {
+		cmd.PrintErrf("failed to connect to NATS: %v\n", err)
+		return
+	}
+	defer nc.Close()
+
+	r := &recorder{
+		enc:     json.NewEncoder(out),
+		pending: make(map[string]*recording),
+		done:    make(chan struct{}),
+		max:     count,
+	}
+
+	// The replies of the server are sent to the inbox of the requester
+	replies, err := nc.Subscribe(nats.InboxPrefix+">", r.onReply)
+	if err != nil {
+		cmd.PrintErrf("failed to subscribe to replies: %v\n", err)
+		return
+	}
+	defer replies.Unsubscribe()
+
+	subject := cmd.Flag("subject").Value.String()
+	sub, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+		r.onMessage(msg, timeout)
+	})
+	if err != nil {
+		cmd.PrintErrf("failed to subscribe to %s: %v\n", subject, err)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	cmd.PrintErrf("Recording messages sent to %s...\n", subject)
+	select {
+	case <-ctx.Done():
+	case <-r.done:
+	}
+
+	// The messages still waiting on their reply are kept without it
+	r.mu.Lock()
+	for reply := range r.pending {
+		r.flush(reply)
+	}
+	r.mu.Unlock()
+
+	cmd.PrintErrf("Recorded %d messages\n", r.count)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/cobra"
+
+	"github.com/numkem/msgscript/executor"
+	msgplugin "github.com/numkem/msgscript/plugins"
+	scriptLib "github.com/numkem/msgscript/script"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay [recording]",
+	Args:  validateArgIsPath,
+	Short: "replay recorded messages and compare the replies with the recorded ones",
+	Long:  "replay the messages of a recording, either through a running server or with the scripts of a local directory like the dev command, and show the differences between the new replies and the recorded ones. The local scripts only return their own results: the next scripts, the pipelines and the aggregation of the server aren't run",
+	Run:   replayCmdRun,
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	replayCmd.PersistentFlags().StringP("script", "S", "", "Run the messages locally with this script, or the scripts of this directory, instead of sending them to the server")
+	replayCmd.PersistentFlags().StringP("library", "l", "", "Path to a folder containing libraries to load for the local scripts")
+	replayCmd.PersistentFlags().StringP("pluginDir", "p", "", "Path to a folder with plugins for the local scripts")
+	replayCmd.PersistentFlags().Duration("timeout", 10*time.Second, "How long to wait for the reply of each message")
+	replayCmd.PersistentFlags().StringSlice("strip-header", nil, "Other recorded headers not to send again, like the dedup keys of the scripts")
+}
+
+// The recorded headers set for the transport of the message that aren't sent again: the deadline and the pipeline
+// depth would be stale, the trace would be joined and the message ID would be deduplicated
+var transportHeaders = []string{
+	"Msgscript-Deadline",
+	"Msgscript-Pipeline-Depth",
+	scriptLib.DEDUP_KEY_MSG_ID,
+	"traceparent",
+	"tracestate",
+	"baggage",
+}
+
+// stripped tells if the recorded header isn't sent again
+func stripped(name string, strip []string) bool {
+	// NATS keeps the case of the header names as they were sent
+	match := func(s string) bool { return strings.EqualFold(s, name) }
+	return slices.ContainsFunc(strip, match) || slices.ContainsFunc(transportHeaders, match)
+}
+
+// replayHeaders returns the recorded headers without the stripped ones
+func replayHeaders(recorded nats.Header, strip []string) nats.Header {
+	headers := make(nats.Header)
+	for k, vv := range recorded {
+		if !stripped(k, strip) {
+			headers[k] = vv
+		}
+	}
+
+	return headers
+}
+
+// replayMessage returns a copy of the recorded message without the stripped headers, the message was recorded
+// with the headers of the NATS message so they would be sent again along with it
+func replayMessage(recorded *executor.Message, strip []string) *executor.Message {
+	m := *recorded
+	m.Headers = make(map[string]string)
+	for k, v := range recorded.Headers {
+		if !stripped(k, strip) {
+			m.Headers[k] = v
+		}
+	}
+
+	return &m
+}
+
+// replayer sends a recorded message again and returns the new results
+type replayer func(ctx context.Context, rec *recording) (*recordedReply, error)
+
+// serverReplayer sends the message through NATS to the running servers
+func serverReplayer(nc *nats.Conn, timeout time.Duration, strip []string) replayer {
+	return func(ctx context.Context, rec *recording) (*recordedReply, error) {
+		// Raw messages are sent back as they were received
+		data := rec.Message.Payload
+		if !rec.Message.Raw {
+			var err error
+			data, err = json.Marshal(replayMessage(rec.Message, strip))
+			if err != nil {
+				return nil, fmt.Errorf("failed to serialize message: %w", err)
+			}
+		}
+
+		msg := nats.NewMsg(rec.Subject)
+		msg.Data = data
+		for k, vv := range replayHeaders(rec.Headers, strip) {
+			for _, v := range vv {
+				msg.Header.Add(k, v)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		resp, err := nc.RequestMsgWithContext(ctx, msg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send message: %w", err)
+		}
+
+		rep := &recordedReply{Headers: resp.Header}
+		err = json.Unmarshal(resp.Data, rep)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode reply: %w", err)
+		}
+
+		return rep, nil
+	}
+}
+
+// localReplayer runs the scripts of the store matching the message's subject with the local executors. Only the
+// results of the scripts are returned, the server's handling of their next scripts, pipelines and aggregation isn't
+// done here.
+func localReplayer(store msgstore.ScriptStore, executors map[string]executor.Executor) replayer {
+	return func(ctx context.Context, rec *recording) (*recordedReply, error) {
+		scripts, err := matchScripts(ctx, store, rec.Subject)
+		if err != nil {
+			return nil, err
+		}
+
+		rep := new(recordedReply)
+		if len(scripts) == 0 {
+			rep.Error = (&executor.NoScriptFoundError{}).Error()
+			return rep, nil
+		}
+
+		for _, scr := range scripts {
+			exec, err := executor.ExecutorByName(scr.Executor, executors)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get executor for script %s: %w", scr.Name, err)
+			}
+
+			m := *rec.Message
+			res := exec.HandleMessage(ctx, &m, scr)
+			if res.Name == "" {
+				res.Name = scr.Name
+			}
+			rep.Results = append(rep.Results, res)
+		}
+
+		return rep, nil
+	}
+}
+
+// matchScripts returns the scripts of the subjects matching the message's subject, keyed by subject and name
+// like the server does
+func matchScripts(ctx context.Context, store msgstore.ScriptStore, subject string) (map[string]*scriptLib.Script, error) {
+	subjects, err := store.ListSubjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subjects: %w", err)
+	}
+
+	scripts := make(map[string]*scriptLib.Script)
+	for _, pattern := range subjects {
+		if !msgstore.SubjectMatches(pattern, subject) {
+			continue
+		}
+
+		named, err := store.GetScripts(ctx, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get scripts of %s: %w", pattern, err)
+		}
+		for name, scr := range named {
+			scripts[strings.Join([]string{pattern, name}, "/")] = scr
+		}
+	}
+
+	return scripts, nil
+}
+
+// localScriptStore returns a store holding the script or all the scripts of the directory
+func localScriptStore(ctx context.Context, scriptPath, libraryPath string) (msgstore.ScriptStore, error) {
+	store, err := msgstore.NewDevStore(libraryPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create store: %w", err)
+	}
+
+	stat, err := os.Stat(scriptPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script path %s: %w", scriptPath, err)
+	}
+
+	scripts := make(map[string]map[string]*scriptLib.Script)
+	if stat.IsDir() {
+		scripts, err = scriptLib.ReadScriptDirectory(scriptPath, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read scripts of %s: %w", scriptPath, err)
+		}
+	} else {
+		scr, err := scriptLib.ReadFile(scriptPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the script file %s: %w", scriptPath, err)
+		}
+		scripts[scr.Subject] = map[string]*scriptLib.Script{scr.Name: scr}
+	}
+
+	for subject, named := range scripts {
+		for name, scr := range named {
+			err = store.AddScript(ctx, subject, name, scr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to add script %s to store: %w", name, err)
+			}
+		}
+	}
+
+	return store, nil
+}
+
+// sameJSON tells if both payloads are the same, ignoring the formatting when they are JSON
+func sameJSON(a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(va, vb)
+}
+
+// diffReplies returns the differences between the recorded and the new reply, comparing the results by script name
+func diffReplies(recorded, replayed *recordedReply) []string {
+	var diffs []string
+	if recorded.Error != replayed.Error {
+		diffs = append(diffs, fmt.Sprintf("error: %q -> %q", recorded.Error, replayed.Error))
+	}
+
+	byName := func(results []*executor.ScriptResult) map[string]*executor.ScriptResult {
+		named := make(map[string]*executor.ScriptResult)
+		for _, res := range results {
+			named[res.Name] = res
+		}
+		return named
+	}
+	before := byName(recorded.Results)
+	after := byName(replayed.Results)
+
+	var names []string
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, found := before[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		b, a := before[name], after[name]
+		switch {
+		case b == nil:
+			diffs = append(diffs, fmt.Sprintf("%s: new result %q", name, a.Payload))
+		case a == nil:
+			diffs = append(diffs, fmt.Sprintf("%s: missing result", name))
+		default:
+			if b.Error != a.Error {
+				diffs = append(diffs, fmt.Sprintf("%s: error %q -> %q", name, b.Error, a.Error))
+			}
+			if b.Code != a.Code {
+				diffs = append(diffs, fmt.Sprintf("%s: code %d -> %d", name, b.Code, a.Code))
+			}
+			if !reflect.DeepEqual(b.Headers, a.Headers) && (len(b.Headers) > 0 || len(a.Headers) > 0) {
+				diffs = append(diffs, fmt.Sprintf("%s: headers %v -> %v", name, b.Headers, a.Headers))
+			}
+			if !sameJSON(b.Payload, a.Payload) {
+				diffs = append(diffs, fmt.Sprintf("%s: payload %q -> %q", name, b.Payload, a.Payload))
+			}
+		}
+	}
+
+	return diffs
+}
+
+func replayCmdRun(cmd *cobra.Command, args []string) {
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		cmd.PrintErrf("failed to get timeout flag: %v\n", err)
+		return
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		cmd.PrintErrf("failed to open recording %s: %v\n", args[0], err)
+		return
+	}
+	defer f.Close()
+
+	strip, err := cmd.Flags().GetStringSlice("strip-header")
+	if err != nil {
+		cmd.PrintErrf("failed to get strip-header flag: %v\n", err)
+		return
+	}
+
+	var replay replayer
+	if scriptPath := cmd.Flag("script").Value.String(); scriptPath != "" {
+		store, err := localScriptStore(cmd.Context(), scriptPath, cmd.Flag("library").Value.String())
+		if err != nil {
+			cmd.PrintErrf("%v\n", err)
+			return
+		}
+
+		var plugins []msgplugin.PreloadFunc
+		if path := cmd.Flag("pluginDir").Value.String(); path != "" {
+			plugins, err = msgplugin.ReadPluginDir(path)
+			if err != nil {
+				cmd.PrintErrf("failed to read plugins: %v\n", err)
+				return
+			}
+		}
+
+		executors := executor.StartAllExecutors(cmd.Context(), store, plugins, nil, executor.LuaOptions{})
+		defer executor.StopAllExecutors(executors)
+
+		replay = localReplayer(store, executors)
+	} else {
+		nc, err := nats.Connect(cmd.Flag("natsurl").Value.String())
+		if err != nil {
+			cmd.PrintErrf("failed to connect to NATS: %v\n", err)
+			return
+		}
+		defer nc.Close()
+
+		replay = serverReplayer(nc, timeout, strip)
+	}
+
+	var total, same, changed, failed int
+	scanner := bufio.NewScanner(f)
+	// Recorded messages can be bigger than the default buffer
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		rec := new(recording)
+		err = json.Unmarshal(scanner.Bytes(), rec)
+		if err != nil || rec.Message == nil {
+			cmd.PrintErrf("line %d: invalid recording: %v\n", line, err)
+			failed++
+			continue
+		}
+		total++
+
+		rep, err := replay(cmd.Context(), rec)
+		if err != nil {
+			cmd.Printf("line %d (%s): failed: %v\n", line, rec.Subject, err)
+			failed++
+			continue
+		}
+
+		if rec.Reply == nil {
+			cmd.Printf("line %d (%s): no recorded reply to compare with\n", line, rec.Subject)
+			continue
+		}
+
+		diffs := diffReplies(rec.Reply, rep)
+		if len(diffs) == 0 {
+			same++
+			continue
+		}
+
+		changed++
+		cmd.Printf("line %d (%s): reply changed\n", line, rec.Subject)
+		for _, d := range diffs {
+			cmd.Printf("  %s\n", d)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.PrintErrf("failed to read recording: %v\n", err)
+	}
+
+	cmd.Printf("Replayed %d messages: %d identical, %d changed, %d failed\n", total, same, changed, failed)
+}
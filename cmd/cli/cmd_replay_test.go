@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/numkem/msgscript/executor"
+	scriptLib "github.com/numkem/msgscript/script"
+)
+
+// startTestNats starts an embedded NATS server, stopped at the end of the test
+func startTestNats(t *testing.T) *nats.Conn {
+	ns, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: -1})
+	assert.NoError(t, err)
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+	assert.True(t, ns.ReadyForConnections(5*time.Second))
+
+	nc, err := nats.Connect(ns.ClientURL())
+	assert.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	return nc
+}
+
+func TestRecordReplay(t *testing.T) {
+	nc := startTestNats(t)
+
+	// Stands for the server, replying with the payload in upper case or lower case
+	var lower atomic.Bool
+	_, err := nc.Subscribe("greet", func(msg *nats.Msg) {
+		m := executor.ParseMessage(msg.Subject, msg.Data, msg.Header)
+		payload := strings.ToUpper(string(m.Payload))
+		if lower.Load() {
+			payload = strings.ToLower(payload)
+		}
+
+		data, _ := json.Marshal(&recordedReply{Results: []*executor.ScriptResult{{Name: "greet", Payload: []byte(payload)}}})
+		msg.Respond(data)
+	})
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	r := &recorder{
+		enc:     json.NewEncoder(&out),
+		pending: make(map[string]*recording),
+		done:    make(chan struct{}),
+		max:     2,
+	}
+	replies, err := nc.Subscribe(nats.InboxPrefix+">", r.onReply)
+	assert.NoError(t, err)
+	defer replies.Unsubscribe()
+	sub, err := nc.Subscribe("greet", func(msg *nats.Msg) { r.onMessage(msg, time.Second) })
+	assert.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	for _, payload := range []string{"hello", `{"payload":"d29ybGQ="}`} {
+		_, err = nc.Request("greet", []byte(payload), time.Second)
+		assert.NoError(t, err)
+	}
+	select {
+	case <-r.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("messages weren't recorded")
+	}
+
+	// Replaying the recording gets the same replies until the server changes
+	var recordings []*recording
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		rec := new(recording)
+		assert.NoError(t, dec.Decode(rec))
+		recordings = append(recordings, rec)
+	}
+	if !assert.Len(t, recordings, 2) {
+		return
+	}
+	assert.True(t, recordings[0].Message.Raw)
+	assert.Equal(t, "WORLD", string(recordings[1].Reply.Results[0].Payload))
+
+	replay := serverReplayer(nc, time.Second, nil)
+	for _, rec := range recordings {
+		rep, err := replay(context.Background(), rec)
+		assert.NoError(t, err)
+		assert.Empty(t, diffReplies(rec.Reply, rep))
+	}
+
+	lower.Store(true)
+	rep, err := replay(context.Background(), recordings[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`greet: payload "HELLO" -> "hello"`}, diffReplies(recordings[0].Reply, rep))
+}
+
+func TestServerReplayerDedup(t *testing.T) {
+	nc := startTestNats(t)
+
+	// Like the server, the script doesn't run again for a message ID it already handled, whether the ID comes
+	// from the headers of the NATS message or the ones of the JSON message
+	seen := make(map[string]bool)
+	var runs atomic.Int32
+	_, err := nc.Subscribe("replay", func(msg *nats.Msg) {
+		m := executor.ParseMessage(msg.Subject, msg.Data, msg.Header)
+		res := &executor.ScriptResult{Payload: m.Payload}
+		if id := m.Headers[scriptLib.DEDUP_KEY_MSG_ID]; id != "" && seen[id] {
+			res.Error = "duplicate"
+		} else {
+			seen[id] = true
+			runs.Add(1)
+		}
+
+		data, _ := json.Marshal(&recordedReply{Results: []*executor.ScriptResult{res}})
+		msg.Respond(data)
+	})
+	assert.NoError(t, err)
+
+	header := nats.Header{scriptLib.DEDUP_KEY_MSG_ID: []string{"1"}, "X-Kept": []string{"kept"}}
+	data := []byte(`{"payload":"aGVsbG8="}`)
+	_, err = nc.RequestMsg(&nats.Msg{Subject: "replay", Data: data, Header: header}, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), runs.Load())
+
+	rec := &recording{
+		Headers: header,
+		Message: executor.ParseMessage("replay", data, header),
+		Subject: "replay",
+	}
+	assert.Equal(t, "1", rec.Message.Headers[scriptLib.DEDUP_KEY_MSG_ID])
+
+	rep, err := serverReplayer(nc, time.Second, nil)(context.Background(), rec)
+	assert.NoError(t, err)
+	assert.Equal(t, "", rep.Results[0].Error)
+	assert.Equal(t, "hello", string(rep.Results[0].Payload))
+	assert.Equal(t, int32(2), runs.Load())
+
+	// The recording itself is left as it is
+	assert.Equal(t, "1", rec.Message.Headers[scriptLib.DEDUP_KEY_MSG_ID])
+}
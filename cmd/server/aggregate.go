@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+// namedResults are the results of a script, or of the last step of its pipeline
+type namedResults struct {
+	name    string
+	results []*executor.ScriptResult
+}
+
+// aggregationFor returns the aggregation mode requested by the message, falling back on the one defined by the scripts
+func aggregationFor(m *executor.Message, scripts map[string]*script.Script) string {
+	if m.Aggregate != "" {
+		return m.Aggregate
+	}
+
+	// Scripts sharing a subject should agree on the mode, the first one by name wins otherwise
+	var names []string
+	for name := range scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if scripts[name].Aggregate != "" {
+			return scripts[name].Aggregate
+		}
+	}
+
+	return executor.AGGREGATE_ALL
+}
+
+// aggregateResults combines the results of all the scripts that ran for a message according to the mode
+func aggregateResults(mode string, all []*namedResults) ([]*executor.ScriptResult, error) {
+	switch mode {
+	case executor.AGGREGATE_ALL, "":
+		return flattenResults(all), nil
+
+	case executor.AGGREGATE_ORDERED_BY_NAME:
+		return flattenResults(sortedByName(all)), nil
+
+	case executor.AGGREGATE_FIRST_SUCCESS:
+		// The results are in the order the scripts finished
+		results := flattenResults(all)
+		for _, res := range results {
+			if res.Error == "" {
+				return []*executor.ScriptResult{res}, nil
+			}
+		}
+
+		// Nothing succeeded, return the first error by name
+		results = flattenResults(sortedByName(all))
+		if len(results) > 0 {
+			return results[:1], nil
+		}
+
+		return results, nil
+
+	case executor.AGGREGATE_MERGE_JSON:
+		res, err := mergeJSONResults(flattenResults(sortedByName(all)))
+		if err != nil {
+			return nil, err
+		}
+
+		return []*executor.ScriptResult{res}, nil
+	}
+
+	return nil, fmt.Errorf("unknown aggregation mode %s", mode)
+}
+
+func flattenResults(all []*namedResults) []*executor.ScriptResult {
+	var results []*executor.ScriptResult
+	for _, nr := range all {
+		results = append(results, nr.results...)
+	}
+
+	return results
+}
+
+func sortedByName(all []*namedResults) []*namedResults {
+	sorted := make([]*namedResults, len(all))
+	copy(sorted, all)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].name < sorted[j].name
+	})
+
+	return sorted
+}
+
+// mergeJSONResults deep-merges the JSON object payloads of the successful results into a single result.
+// When keys conflict, the value of the last result wins. Errors of the failed results are joined.
+func mergeJSONResults(results []*executor.ScriptResult) (*executor.ScriptResult, error) {
+	merged := make(map[string]any)
+	res := &executor.ScriptResult{
+		Headers: make(map[string]string),
+	}
+
+	var errs []string
+	for _, r := range results {
+		if r.Error != "" {
+			errs = append(errs, r.Error)
+			continue
+		}
+
+		obj := make(map[string]any)
+		if len(r.Payload) > 0 {
+			err := json.Unmarshal(r.Payload, &obj)
+			if err != nil {
+				return nil, fmt.Errorf("payload of script %s isn't a JSON object: %w", r.Name, err)
+			}
+		}
+		deepMerge(merged, obj)
+
+		for k, v := range r.Headers {
+			res.Headers[k] = v
+		}
+		if r.HTTPStatus {
+			res.Code = max(res.Code, r.Code)
+			res.HTTPStatus = true
+		}
+	}
+
+	payload, err := json.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode merged payload: %w", err)
+	}
+	res.Payload = payload
+	res.Error = strings.Join(errs, "; ")
+
+	return res, nil
+}
+
+// deepMerge merges src into dst, merging the nested objects instead of replacing them
+func deepMerge(dst, src map[string]any) {
+	for k, v := range src {
+		srcObj, srcIsObj := v.(map[string]any)
+		dstObj, dstIsObj := dst[k].(map[string]any)
+		if srcIsObj && dstIsObj {
+			deepMerge(dstObj, srcObj)
+			continue
+		}
+
+		dst[k] = v
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/numkem/msgscript/executor"
+)
+
+func testResults() []*namedResults {
+	return []*namedResults{
+		{name: "b", results: []*executor.ScriptResult{{Name: "b", Payload: []byte(`{"user":{"name":"bob"},"count":2}`)}}},
+		{name: "c", results: []*executor.ScriptResult{{Name: "c", Error: "failed"}}},
+		{name: "a", results: []*executor.ScriptResult{{Name: "a", Payload: []byte(`{"user":{"id":1},"count":1}`)}}},
+	}
+}
+
+func TestAggregateOrderedByName(t *testing.T) {
+	results, err := aggregateResults(executor.AGGREGATE_ORDERED_BY_NAME, testResults())
+	assert.Nil(t, err)
+
+	var names []string
+	for _, res := range results {
+		names = append(names, res.Name)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, names)
+}
+
+func TestAggregateFirstSuccess(t *testing.T) {
+	results, err := aggregateResults(executor.AGGREGATE_FIRST_SUCCESS, testResults())
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "b", results[0].Name)
+}
+
+func TestAggregateMergeJSON(t *testing.T) {
+	results, err := aggregateResults(executor.AGGREGATE_MERGE_JSON, testResults())
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.JSONEq(t, `{"user":{"id":1,"name":"bob"},"count":2}`, string(results[0].Payload))
+	assert.Equal(t, "failed", results[0].Error)
+
+	_, err = aggregateResults(executor.AGGREGATE_MERGE_JSON, []*namedResults{
+		{name: "a", results: []*executor.ScriptResult{{Name: "a", Payload: []byte(`not json`)}}},
+	})
+	assert.NotNil(t, err)
+}
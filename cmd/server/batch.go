@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+// How long a batch waits for more messages when the script doesn't define its window
+const DEFAULT_BATCH_WINDOW = 1 * time.Second
+
+// pendingBatch holds the messages waiting for the batch to be run
+type pendingBatch struct {
+	ctx     context.Context
+	exec    executor.Executor
+	scr     *script.Script
+	msgs    []*executor.Message
+	results []chan *executor.ScriptResult
+	timer   *time.Timer
+}
+
+// batcher buffers the messages of the scripts handling them in batches until the batch is full
+// or its window is over. The batch takes a slot of the concurrency limits once it runs, not the messages waiting
+// in it.
+type batcher struct {
+	mu      sync.Mutex
+	batches map[string]*pendingBatch
+	limits  *concurrencyLimiter
+}
+
+func newBatcher(limits *concurrencyLimiter) *batcher {
+	return &batcher{
+		batches: make(map[string]*pendingBatch),
+		limits:  limits,
+	}
+}
+
+// add puts the message in the script's current batch and waits for the result of the message
+func (b *batcher) add(ctx context.Context, exec executor.Executor, m *executor.Message, scr *script.Script) *executor.ScriptResult {
+	key := strings.Join([]string{scr.Subject, scr.Name}, "/")
+	result := make(chan *executor.ScriptResult, 1)
+
+	b.mu.Lock()
+	pb, found := b.batches[key]
+	if !found {
+		window := scr.BatchWindow
+		if window <= 0 {
+			window = DEFAULT_BATCH_WINDOW
+		}
+
+		// The batch outlives the message that started it, only its trace is kept
+		pb = &pendingBatch{ctx: trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)), exec: exec, scr: scr}
+		pb.timer = time.AfterFunc(window, func() {
+			b.flush(key, pb)
+		})
+		b.batches[key] = pb
+	}
+
+	pb.msgs = append(pb.msgs, m)
+	pb.results = append(pb.results, result)
+	full := len(pb.msgs) >= scr.Batch
+	b.mu.Unlock()
+
+	if full {
+		go b.flush(key, pb)
+	}
+
+	select {
+	case res := <-result:
+		return res
+	case <-ctx.Done():
+		return &executor.ScriptResult{Error: fmt.Sprintf("message is still waiting in its batch: %v", ctx.Err())}
+	}
+}
+
+// flush runs the batch if it wasn't already and sends the result of each message
+func (b *batcher) flush(key string, pb *pendingBatch) {
+	b.mu.Lock()
+	if b.batches[key] != pb {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.batches, key)
+	pb.timer.Stop()
+	b.mu.Unlock()
+
+	ctx, span := mainTracer.Start(pb.ctx, "batch.run", trace.WithAttributes(
+		attribute.String("script.name", pb.scr.Name),
+		attribute.Int("batch.size", len(pb.msgs)),
+	))
+	defer span.End()
+
+	fields := log.Fields{
+		"subject": pb.scr.Subject,
+		"name":    pb.scr.Name,
+		"size":    len(pb.msgs),
+	}
+
+	if b.limits != nil {
+		release, err := b.limits.acquire(ctx, pb.scr)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Batch not allowed to run")
+			log.WithFields(fields).Warnf("batch not run: %v", err)
+
+			for _, ch := range pb.results {
+				ch <- &executor.ScriptResult{Error: err.Error()}
+			}
+			return
+		}
+		defer release()
+	}
+
+	log.WithFields(fields).Debug("running batch")
+
+	results := pb.exec.HandleBatch(ctx, pb.msgs, pb.scr)
+	if len(results) != len(pb.msgs) {
+		err := fmt.Errorf("batch returned %d results for %d messages", len(results), len(pb.msgs))
+		span.RecordError(err)
+		results = make([]*executor.ScriptResult, len(pb.msgs))
+		for i := range results {
+			results[i] = &executor.ScriptResult{Error: err.Error()}
+		}
+	}
+
+	for i, ch := range pb.results {
+		ch <- results[i]
+	}
+
+	span.SetStatus(codes.Ok, "Batch run")
+}
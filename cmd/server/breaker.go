@@ -0,0 +1,180 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+const (
+	// How many consecutive failures open the breaker of a script, 0 disables the breakers
+	DEFAULT_BREAKER_THRESHOLD = 5
+	// How long an open breaker rejects the messages before letting one through to test the script again
+	DEFAULT_BREAKER_COOLDOWN = 30 * time.Second
+	// How long the messages rejected while the half-open breaker tests the script are told to wait
+	BREAKER_PROBE_WAIT = time.Second
+
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half-open"
+)
+
+// breaker is the state of the circuit breaker of a single script
+type breaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+	// Only a single message is let through while half-open
+	probing bool
+}
+
+// circuitBreakers stops running the scripts failing repeatedly for a while. Each instance of the server keeps
+// its own breakers.
+type circuitBreakers struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	breakers  map[string]*breaker
+	now       func() time.Time
+}
+
+func newCircuitBreakers(threshold int, cooldown time.Duration) *circuitBreakers {
+	return &circuitBreakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		breakers:  make(map[string]*breaker),
+		now:       time.Now,
+	}
+}
+
+func breakerKey(subject, name string) string {
+	return strings.Join([]string{subject, name}, "/")
+}
+
+// allow tells if the script can run, returning the state of its breaker. When the breaker is open, the returned
+// duration is how long until it lets a message through again. While a half-open breaker tests the script, the
+// other messages are told to wait for BREAKER_PROBE_WAIT since the test could close it by then.
+func (cb *circuitBreakers) allow(scr *script.Script) (string, time.Duration, bool) {
+	if cb == nil || cb.threshold <= 0 {
+		return BREAKER_CLOSED, 0, true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	b, found := cb.breakers[breakerKey(scr.Subject, scr.Name)]
+	if !found {
+		return BREAKER_CLOSED, 0, true
+	}
+
+	switch b.state {
+	case BREAKER_OPEN:
+		wait := b.openedAt.Add(cb.cooldown).Sub(cb.now())
+		if wait > 0 {
+			return b.state, wait, false
+		}
+
+		b.state = BREAKER_HALF_OPEN
+		b.probing = true
+		return b.state, 0, true
+	case BREAKER_HALF_OPEN:
+		if b.probing {
+			return b.state, BREAKER_PROBE_WAIT, false
+		}
+
+		b.probing = true
+		return b.state, 0, true
+	}
+
+	return b.state, 0, true
+}
+
+// record updates the breaker of the script with the result of its run
+func (cb *circuitBreakers) record(scr *script.Script, res *executor.ScriptResult) {
+	if cb == nil || cb.threshold <= 0 {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	key := breakerKey(scr.Subject, scr.Name)
+	b, found := cb.breakers[key]
+
+	switch res.Error {
+	case "":
+		// Scripts without failures don't need to be tracked
+		delete(cb.breakers, key)
+	case (&executor.LockNotAcquiredError{}).Error():
+		// The script ran on another instance, it tells nothing about its health
+		if found {
+			b.probing = false
+		}
+	default:
+		if !found {
+			b = &breaker{state: BREAKER_CLOSED}
+			cb.breakers[key] = b
+		}
+
+		b.failures++
+		b.probing = false
+		if b.state == BREAKER_HALF_OPEN || b.failures >= cb.threshold {
+			b.state = BREAKER_OPEN
+			b.openedAt = cb.now()
+		}
+	}
+}
+
+// info returns the state of the script's breaker along with its consecutive failures and when it was last opened
+func (cb *circuitBreakers) info(subject, name string) (string, int, time.Time) {
+	if cb == nil || cb.threshold <= 0 {
+		return "", 0, time.Time{}
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	b, found := cb.breakers[breakerKey(subject, name)]
+	if !found {
+		return BREAKER_CLOSED, 0, time.Time{}
+	}
+
+	return b.state, b.failures, b.openedAt
+}
+
+func circuitOpenResult(scr *script.Script, wait time.Duration) *executor.ScriptResult {
+	return &executor.ScriptResult{
+		Name:  scr.Name,
+		Error: (&executor.CircuitOpenError{}).Error(),
+		Headers: map[string]string{
+			RETRY_AFTER_HEADER: strconv.Itoa(int(math.Ceil(wait.Seconds()))),
+		},
+	}
+}
+
+// circuitOpen tells if all the scripts were rejected by their breaker, along with the longest delay before
+// retrying in seconds
+func circuitOpen(results []*executor.ScriptResult) (string, bool) {
+	if len(results) == 0 {
+		return "", false
+	}
+
+	var retryAfter int
+	for _, res := range results {
+		if res.Error != (&executor.CircuitOpenError{}).Error() {
+			return "", false
+		}
+
+		seconds, err := strconv.Atoi(res.Headers[RETRY_AFTER_HEADER])
+		if err == nil && seconds > retryAfter {
+			retryAfter = seconds
+		}
+	}
+
+	return strconv.Itoa(retryAfter), true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+func TestCircuitBreakers(t *testing.T) {
+	now := time.Now()
+	cb := newCircuitBreakers(2, time.Minute)
+	cb.now = func() time.Time { return now }
+
+	scr := &script.Script{Subject: "test", Name: "failing"}
+	failed := &executor.ScriptResult{Error: "downstream is down"}
+
+	cb.record(scr, failed)
+	state, _, allowed := cb.allow(scr)
+	assert.True(t, allowed)
+	assert.Equal(t, BREAKER_CLOSED, state)
+
+	// Opens on the second consecutive failure
+	cb.record(scr, failed)
+	state, wait, allowed := cb.allow(scr)
+	assert.False(t, allowed)
+	assert.Equal(t, BREAKER_OPEN, state)
+	assert.Equal(t, time.Minute, wait)
+
+	state, failures, openedAt := cb.info("test", "failing")
+	assert.Equal(t, BREAKER_OPEN, state)
+	assert.Equal(t, 2, failures)
+	assert.Equal(t, now, openedAt)
+
+	// A single message is let through once cooled down
+	now = now.Add(time.Minute)
+	state, _, allowed = cb.allow(scr)
+	assert.True(t, allowed)
+	assert.Equal(t, BREAKER_HALF_OPEN, state)
+	_, wait, allowed = cb.allow(scr)
+	assert.False(t, allowed)
+	assert.Equal(t, BREAKER_PROBE_WAIT, wait)
+
+	// The probe failing opens it again
+	cb.record(scr, failed)
+	state, _, allowed = cb.allow(scr)
+	assert.False(t, allowed)
+	assert.Equal(t, BREAKER_OPEN, state)
+
+	// The probe succeeding closes it
+	now = now.Add(time.Minute)
+	_, _, allowed = cb.allow(scr)
+	assert.True(t, allowed)
+	cb.record(scr, &executor.ScriptResult{})
+	state, _, allowed = cb.allow(scr)
+	assert.True(t, allowed)
+	assert.Equal(t, BREAKER_CLOSED, state)
+
+	_, _, allowed = newCircuitBreakers(0, time.Minute).allow(scr)
+	assert.True(t, allowed)
+}
+
+func TestCircuitBreakersConcurrentProbe(t *testing.T) {
+	now := time.Now()
+	cb := newCircuitBreakers(1, time.Minute)
+	cb.now = func() time.Time { return now }
+
+	scr := &script.Script{Subject: "test", Name: "failing"}
+	cb.record(scr, &executor.ScriptResult{Error: "downstream is down"})
+	now = now.Add(time.Minute)
+
+	// Only one of the messages received once cooled down tests the script, the others are told when to come back
+	var wg sync.WaitGroup
+	results := make(chan *executor.ScriptResult, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, wait, allowed := cb.allow(scr)
+			if allowed {
+				results <- nil
+			} else {
+				results <- circuitOpenResult(scr, wait)
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var probes int
+	for res := range results {
+		if res == nil {
+			probes++
+			continue
+		}
+		assert.Equal(t, "1", res.Headers[RETRY_AFTER_HEADER])
+	}
+	assert.Equal(t, 1, probes)
+}
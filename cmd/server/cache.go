@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+const CACHE_KEY_PREFIX = "cache"
+
+type cachedResult struct {
+	res     *executor.ScriptResult
+	expires time.Time
+}
+
+// resultCache keeps the successful results of the scripts defining a cache duration, either in memory or in the store.
+// The entries of the store are keyed by a generation of their subject, purging the subject moves it to the next one.
+type resultCache struct {
+	mu    sync.Mutex
+	store msgstore.ScriptStore
+	local map[string]map[string]*cachedResult
+}
+
+func newResultCache(store msgstore.ScriptStore) *resultCache {
+	return &resultCache{
+		store: store,
+		local: make(map[string]map[string]*cachedResult),
+	}
+}
+
+// cacheKey returns the hash of what identifies the message for the script: its subject, method, URL, payload and
+// the headers chosen by the script
+func cacheKey(m *executor.Message, scr *script.Script) string {
+	h := sha256.New()
+	for _, s := range []string{m.Subject, scr.Name, m.Method, m.URL} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	h.Write(m.Payload)
+	for _, name := range scr.CacheHeaders {
+		h.Write([]byte{0})
+		h.Write([]byte(name + "=" + messageHeader(m, name)))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func cacheGenerationKey(subject string) string {
+	return strings.Join([]string{CACHE_KEY_PREFIX, subject, "generation"}, "/")
+}
+
+// sharedKey returns the key of the result in the store for the current generation of the subject
+func (c *resultCache) sharedKey(ctx context.Context, subject, key string) (string, error) {
+	gen, err := c.store.GetValue(ctx, cacheGenerationKey(subject))
+	if err != nil {
+		return "", fmt.Errorf("failed to get cache generation: %w", err)
+	}
+	if gen == nil {
+		gen = []byte("0")
+	}
+
+	return strings.Join([]string{CACHE_KEY_PREFIX, subject, string(gen), key}, "/"), nil
+}
+
+// get returns the cached result of the message, if it didn't expire
+func (c *resultCache) get(ctx context.Context, m *executor.Message, scr *script.Script) (*executor.ScriptResult, bool) {
+	key := cacheKey(m, scr)
+
+	if scr.CacheScope == script.CACHE_SCOPE_SHARED {
+		skey, err := c.sharedKey(ctx, scr.Subject, key)
+		if err == nil {
+			var value []byte
+			value, err = c.store.GetValue(ctx, skey)
+			if value == nil || err != nil {
+				return nil, false
+			}
+
+			res := new(executor.ScriptResult)
+			err = json.Unmarshal(value, res)
+			if err == nil {
+				return res, true
+			}
+		}
+
+		log.WithField("subject", m.Subject).WithField("name", scr.Name).Warnf("failed to get cached result: %v", err)
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, found := c.local[scr.Subject][key]
+	if !found || time.Now().After(cached.expires) {
+		return nil, false
+	}
+
+	// The result can be changed by the handler
+	res := *cached.res
+	return &res, true
+}
+
+// set keeps the result of the message for the script's cache duration
+func (c *resultCache) set(ctx context.Context, m *executor.Message, scr *script.Script, res *executor.ScriptResult) {
+	key := cacheKey(m, scr)
+
+	if scr.CacheScope == script.CACHE_SCOPE_SHARED {
+		skey, err := c.sharedKey(ctx, scr.Subject, key)
+		if err == nil {
+			var value []byte
+			value, err = json.Marshal(res)
+			if err == nil {
+				err = c.store.SetValue(ctx, skey, value, scr.Cache)
+			}
+		}
+		if err != nil {
+			log.WithField("subject", m.Subject).WithField("name", scr.Name).Warnf("failed to cache result: %v", err)
+		}
+
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Expired results are only removed when adding new ones
+	now := time.Now()
+	entries, found := c.local[scr.Subject]
+	if !found {
+		entries = make(map[string]*cachedResult)
+		c.local[scr.Subject] = entries
+	}
+	for k, cached := range entries {
+		if now.After(cached.expires) {
+			delete(entries, k)
+		}
+	}
+
+	r := *res
+	entries[key] = &cachedResult{res: &r, expires: now.Add(scr.Cache)}
+}
+
+// purge removes the cached results of the scripts whose subject matches the given subject (or pattern), or is a
+// pattern matching it. The results are kept by script, so purging a subject handled by a pattern's script removes
+// all the results of that script.
+func (c *resultCache) purge(ctx context.Context, pattern string) error {
+	matches := func(subject string) bool {
+		return msgstore.SubjectMatches(pattern, subject) || msgstore.SubjectMatches(subject, pattern)
+	}
+
+	c.mu.Lock()
+	for subject := range c.local {
+		if matches(subject) {
+			delete(c.local, subject)
+		}
+	}
+	c.mu.Unlock()
+
+	subjects, err := c.store.ListSubjects(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list subjects: %w", err)
+	}
+
+	for _, subject := range subjects {
+		if !matches(subject) {
+			continue
+		}
+
+		err = c.store.UpdateValue(ctx, cacheGenerationKey(subject), 0, func(value []byte) ([]byte, error) {
+			var gen int
+			if value != nil {
+				fmt.Sscan(string(value), &gen)
+			}
+
+			return []byte(fmt.Sprint(gen + 1)), nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to purge cache of %s: %w", subject, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+func TestResultCache(t *testing.T) {
+	ctx := context.Background()
+	store, err := msgstore.NewDevStore("")
+	assert.Nil(t, err)
+
+	for _, scope := range []string{script.CACHE_SCOPE_LOCAL, script.CACHE_SCOPE_SHARED} {
+		scr := &script.Script{Subject: "lookup", Name: "lookup", Cache: time.Minute, CacheHeaders: []string{"Accept-Language"}, CacheScope: scope}
+		assert.Nil(t, store.AddScript(ctx, scr.Subject, scr.Name, scr))
+
+		c := newResultCache(store)
+		m := &executor.Message{Subject: "lookup", Payload: []byte("42"), Headers: map[string]string{"Accept-Language": "fr"}}
+		c.set(ctx, m, scr, &executor.ScriptResult{Name: "lookup", Payload: []byte("found")})
+
+		res, hit := c.get(ctx, m, scr)
+		assert.True(t, hit, scope)
+		assert.Equal(t, []byte("found"), res.Payload, scope)
+
+		// The chosen headers are part of the key
+		_, hit = c.get(ctx, &executor.Message{Subject: "lookup", Payload: []byte("42"), Headers: map[string]string{"Accept-Language": "en"}}, scr)
+		assert.False(t, hit, scope)
+
+		assert.Nil(t, c.purge(ctx, "lookup"))
+		_, hit = c.get(ctx, m, scr)
+		assert.False(t, hit, scope)
+
+		// Purging a subject removes the results of the scripts of the patterns matching it
+		wildcard := &script.Script{Subject: "users.*", Name: "users", Cache: time.Minute, CacheScope: scope}
+		assert.Nil(t, store.AddScript(ctx, wildcard.Subject, wildcard.Name, wildcard))
+		m = &executor.Message{Subject: "users.get", Payload: []byte("42")}
+		c.set(ctx, m, wildcard, &executor.ScriptResult{Name: "users", Payload: []byte("found")})
+
+		assert.Nil(t, c.purge(ctx, "orders.get"))
+		_, hit = c.get(ctx, m, wildcard)
+		assert.True(t, hit, scope)
+
+		assert.Nil(t, c.purge(ctx, "users.get"))
+		_, hit = c.get(ctx, m, wildcard)
+		assert.False(t, hit, scope)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+// chainSteps splits the scripts between the ones running in parallel and the steps of the middleware chain,
+// which are the ones with an order. The steps are sorted by their order, then by their name.
+func chainSteps(scripts map[string]*script.Script) (parallel map[string]*script.Script, steps []*script.Script) {
+	parallel = make(map[string]*script.Script)
+	names := make(map[*script.Script]string)
+	for name, scr := range scripts {
+		if scr.Order == 0 {
+			parallel[name] = scr
+			continue
+		}
+
+		names[scr] = name
+		steps = append(steps, scr)
+	}
+
+	sort.SliceStable(steps, func(i, j int) bool {
+		if steps[i].Order != steps[j].Order {
+			return steps[i].Order < steps[j].Order
+		}
+
+		return names[steps[i]] < names[steps[j]]
+	})
+
+	return parallel, steps
+}
+
+// chainStopped tells if the result of a step stops the chain
+func chainStopped(res *executor.ScriptResult) bool {
+	return res.Error != "" || res.Code >= http.StatusBadRequest
+}
+
+// runChain runs the steps one after the other, each one receiving the payload returned by the previous one.
+// A step stops the chain by failing or returning a code of 400 or more, its result is then the result of the chain.
+// The last step is run as a pipeline so it can forward its result to its next subject.
+func (h *messageHandler) runChain(ctx context.Context, m *executor.Message, steps []*script.Script) []*executor.ScriptResult {
+	ctx, span := mainTracer.Start(ctx, "nats.handle_message.run_chain")
+	defer span.End()
+	span.SetAttributes(attribute.Int("chain.steps", len(steps)))
+
+	// Headers set by the steps are kept in the final result
+	headers := make(map[string]string)
+	withHeaders := func(results []*executor.ScriptResult) []*executor.ScriptResult {
+		for _, res := range results {
+			for k, v := range res.Headers {
+				headers[k] = v
+			}
+			res.Headers = headers
+		}
+
+		return results
+	}
+
+	msg := m
+	for i, scr := range steps {
+		if i == len(steps)-1 {
+			span.SetStatus(codes.Ok, "Chain completed")
+			return withHeaders(h.runPipeline(ctx, msg, scr))
+		}
+
+		res := h.runDeduplicated(ctx, msg, scr, func() []*executor.ScriptResult {
+			return []*executor.ScriptResult{h.runScript(ctx, msg, scr)}
+		})[0]
+		if chainStopped(res) {
+			log.WithField("subject", m.Subject).WithField("name", scr.Name).WithField("code", res.Code).Debug("chain stopped")
+			span.SetAttributes(attribute.String("chain.stopped_by", scr.Name))
+			span.SetStatus(codes.Ok, "Chain stopped")
+
+			return withHeaders([]*executor.ScriptResult{res})
+		}
+
+		for k, v := range res.Headers {
+			headers[k] = v
+		}
+
+		// A step that doesn't return a payload passes the one it received
+		if res.Payload != nil {
+			next := *msg
+			next.Payload = res.Payload
+			msg = &next
+		}
+	}
+
+	return nil
+}
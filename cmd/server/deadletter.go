@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+// How long the dead letters are kept when they aren't re-driven
+const DEAD_LETTER_MAX_AGE = 7 * 24 * time.Hour
+
+// ensureDeadLetterStream creates the stream keeping the dead letters so they can be listed and re-driven later on.
+// The re-driven ones are deleted from the stream.
+func ensureDeadLetterStream(ctx context.Context, js jetstream.JetStream, prefix string) error {
+	// The prefix might have changed since the stream was created
+	return ensureWorkQueueStream(ctx, js, jetstream.StreamConfig{
+		Name:     executor.DEAD_LETTER_STREAM_NAME,
+		Subjects: []string{prefix + ".>"},
+		MaxAge:   DEAD_LETTER_MAX_AGE,
+	})
+}
+
+// isDeadLetter tells if the message was published to the dead-letter subjects, they are never handled by the scripts
+// so a script failing on its own dead letters doesn't publish them again forever
+func (h *messageHandler) isDeadLetter(subject string) bool {
+	return h.deadLetterPrefix != "" && msgstore.SubjectMatches(h.deadLetterPrefix+".>", subject)
+}
+
+// publishDeadLetter publishes the message that the script failed to handle to the dead-letter stream
+func (h *messageHandler) publishDeadLetter(ctx context.Context, m *executor.Message, scr *script.Script, resErr string, attempts int) {
+	if h.deadLetterPrefix == "" {
+		return
+	}
+
+	_, span := mainTracer.Start(ctx, "nats.publish_dead_letter")
+	defer span.End()
+
+	subject := executor.DeadLetterSubject(h.deadLetterPrefix, m.Subject)
+	span.SetAttributes(
+		attribute.String("dlq.subject", subject),
+		attribute.String("script.name", scr.Name),
+		attribute.Int("dlq.attempts", attempts),
+	)
+
+	fields := log.Fields{
+		"subject":  m.Subject,
+		"name":     scr.Name,
+		"attempts": attempts,
+	}
+
+	payload, err := json.Marshal(&executor.DeadLetter{
+		Attempts: attempts,
+		Error:    resErr,
+		Message:  m,
+		Name:     scr.Name,
+		Subject:  m.Subject,
+		Time:     time.Now(),
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to serialize dead letter")
+		log.WithFields(fields).Errorf("failed to serialize dead letter: %v", err)
+		return
+	}
+
+	// The dead letter is only reported once the stream stored it
+	_, err = h.js.Publish(ctx, subject, payload)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to publish dead letter")
+		log.WithFields(fields).Errorf("failed to publish dead letter: %v", err)
+		return
+	}
+
+	log.WithFields(fields).Warnf("script failed, message sent to %s: %s", subject, resErr)
+	span.SetStatus(codes.Ok, "Dead letter published")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+func TestRunScriptRetries(t *testing.T) {
+	ctx := context.Background()
+	nc, js := startTestNats(t)
+	assert.Nil(t, ensureDeadLetterStream(ctx, js, executor.DEFAULT_DEAD_LETTER_PREFIX))
+
+	// The script succeeds on its last retry, after waiting for the backoff before each of them
+	exec := &flakyExecutor{failures: 2}
+	h, _ := newTestHandler(t, nc, js, exec, executor.DEFAULT_DEAD_LETTER_PREFIX)
+	scr := &script.Script{Subject: "work", Name: "flaky", Delivery: script.DELIVERY_QUEUE, Retries: 2, RetryBackoff: 20 * time.Millisecond}
+
+	start := time.Now()
+	res := h.runScript(ctx, &executor.Message{Subject: "work", Payload: []byte("job")}, scr)
+	assert.Equal(t, "", res.Error)
+	assert.Equal(t, int32(3), exec.runs.Load())
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+
+	stream, err := js.Stream(ctx, executor.DEAD_LETTER_STREAM_NAME)
+	assert.Nil(t, err)
+	info, err := stream.Info(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), info.State.Msgs)
+}
+
+func TestRunScriptDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	nc, js := startTestNats(t)
+	assert.Nil(t, ensureDeadLetterStream(ctx, js, executor.DEFAULT_DEAD_LETTER_PREFIX))
+
+	exec := &flakyExecutor{failures: 100}
+	h, store := newTestHandler(t, nc, js, exec, executor.DEFAULT_DEAD_LETTER_PREFIX)
+
+	// A script registered on the dead-letter subjects doesn't handle them
+	store.AddScript(ctx, "msgscript.dlq.>", "alert", &script.Script{Subject: "msgscript.dlq.>", Name: "alert", Delivery: script.DELIVERY_QUEUE})
+	sm := newSubscriptionManager(nc, store, h, DEFAULT_QUEUE_GROUP, nil, nil)
+	sm.refresh(ctx, "msgscript.dlq.>")
+	defer sm.Stop()
+
+	scr := &script.Script{Subject: "work", Name: "failing", Delivery: script.DELIVERY_QUEUE, Retries: 1, RetryBackoff: time.Millisecond}
+	res := h.runScript(ctx, &executor.Message{Subject: "work", Payload: []byte("job")}, scr)
+	assert.Equal(t, "downstream is down", res.Error)
+	assert.Equal(t, int32(2), exec.runs.Load())
+
+	// The dead letter is kept by the stream once the script failed all of its attempts
+	stream, err := js.Stream(ctx, executor.DEAD_LETTER_STREAM_NAME)
+	assert.Nil(t, err)
+	raw, err := stream.GetLastMsgForSubject(ctx, "msgscript.dlq.work")
+	assert.Nil(t, err)
+
+	var dl executor.DeadLetter
+	assert.Nil(t, json.Unmarshal(raw.Data, &dl))
+	assert.Equal(t, 2, dl.Attempts)
+	assert.Equal(t, "failing", dl.Name)
+	assert.Equal(t, "downstream is down", dl.Error)
+	assert.Equal(t, []byte("job"), dl.Message.Payload)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(2), exec.runs.Load())
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"golang.org/x/net/context"
+)
+
+// DEADLINE_HEADER is the NATS header holding the time (RFC3339) after which the caller stops waiting for a reply
+const DEADLINE_HEADER = "Msgscript-Deadline"
+
+// setDeadlineHeader passes the deadline of the context along with the message
+func setDeadlineHeader(ctx context.Context, header nats.Header) {
+	if deadline, ok := ctx.Deadline(); ok {
+		header.Set(DEADLINE_HEADER, deadline.Format(time.RFC3339Nano))
+	}
+}
+
+// withDeadlineHeader bounds the context with the deadline of the message's caller, if it has one
+func withDeadlineHeader(ctx context.Context, header nats.Header) (context.Context, context.CancelFunc) {
+	deadline, err := time.Parse(time.RFC3339Nano, header.Get(DEADLINE_HEADER))
+	if err != nil {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithDeadline(ctx, deadline)
+}
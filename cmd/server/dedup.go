@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+const DEDUP_KEY_PREFIX = "dedup"
+
+// messageHeader returns the value of the header, ignoring the case of its name
+func messageHeader(m *executor.Message, name string) string {
+	if v, found := m.Headers[name]; found {
+		return v
+	}
+
+	for k, v := range m.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// dedupKey returns the key identifying the message for the script. It comes from the header defined by the
+// script (the NATS message ID by default) or from the hash of the payload when the script uses it. It's empty
+// when the message doesn't have the header.
+func dedupKey(m *executor.Message, scr *script.Script) string {
+	header := scr.DedupKey
+	if header == "" {
+		header = script.DEDUP_KEY_MSG_ID
+	}
+
+	h := sha256.New()
+	if header == script.DEDUP_KEY_PAYLOAD {
+		h.Write([]byte(script.DEDUP_KEY_PAYLOAD + ":"))
+		h.Write(m.Payload)
+	} else if v := messageHeader(m, header); v != "" {
+		h.Write([]byte(header + ":" + v))
+	} else {
+		return ""
+	}
+
+	return strings.Join([]string{DEDUP_KEY_PREFIX, scr.Subject, scr.Name, hex.EncodeToString(h.Sum(nil))}, "/")
+}
+
+// The value kept under the key of a message while it's handled for the first time
+var dedupPending = []byte("[]")
+
+// errDuplicate stops the claim of a message that was already claimed
+var errDuplicate = errors.New("duplicate message")
+
+// runDeduplicated runs the script unless the same message was already handled within the script's deduplication
+// window, in which case the results of the first run are returned. The message is claimed before the script runs
+// so the duplicates received in the meantime aren't run as well, the claim is dropped if the script fails.
+func (h *messageHandler) runDeduplicated(ctx context.Context, m *executor.Message, scr *script.Script, run func() []*executor.ScriptResult) []*executor.ScriptResult {
+	if scr.Dedup <= 0 {
+		return run()
+	}
+
+	span := trace.SpanFromContext(ctx)
+	fields := log.Fields{
+		"subject": m.Subject,
+		"name":    scr.Name,
+	}
+	key := dedupKey(m, scr)
+	if key == "" {
+		// Clients not setting the header would flood the logs
+		log.WithFields(fields).Debugf("message doesn't have the %s header, it isn't deduplicated", cmp.Or(scr.DedupKey, script.DEDUP_KEY_MSG_ID))
+		return run()
+	}
+
+	var previous []byte
+	err := h.store.UpdateValue(ctx, key, scr.Dedup, func(value []byte) ([]byte, error) {
+		previous = value
+		if value != nil {
+			return nil, errDuplicate
+		}
+
+		return dedupPending, nil
+	})
+	switch {
+	case errors.Is(err, errDuplicate):
+		span.SetAttributes(attribute.Bool("message.duplicate", true))
+
+		var results []*executor.ScriptResult
+		err = json.Unmarshal(previous, &results)
+		if err != nil {
+			log.WithFields(fields).Warnf("failed to decode the previous results of the message: %v", err)
+		}
+		if len(results) > 0 {
+			log.WithFields(fields).Debug("duplicate message, replying with the previous results")
+			return results
+		}
+
+		log.WithFields(fields).Debug("duplicate message received while the first one is handled")
+
+		// With a broadcast delivery, the other instances received the same message and the one that claimed it
+		// runs the script, like if it took the lock
+		if !scr.Exclusive() {
+			return []*executor.ScriptResult{{Name: scr.Name, Error: (&executor.LockNotAcquiredError{}).Error()}}
+		}
+		return []*executor.ScriptResult{{Name: scr.Name, Error: (&executor.DuplicateInProgressError{}).Error()}}
+	case err != nil:
+		log.WithFields(fields).Warnf("failed to claim the message, it isn't deduplicated: %v", err)
+		return run()
+	}
+
+	results := run()
+	failed := len(results) == 0
+	for _, res := range results {
+		failed = failed || res.Error != ""
+	}
+	if failed {
+		// The message can be handled again
+		err = h.store.DeleteValue(ctx, key)
+		if err != nil {
+			log.WithFields(fields).Warnf("failed to drop the claim of the message: %v", err)
+		}
+		return results
+	}
+
+	value, err := json.Marshal(results)
+	if err == nil {
+		err = h.store.SetValue(ctx, key, value, scr.Dedup)
+	}
+	if err != nil {
+		log.WithFields(fields).Warnf("failed to keep the results of the message: %v", err)
+	}
+
+	return results
+}
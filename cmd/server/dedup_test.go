@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+func TestDedupKey(t *testing.T) {
+	scr := &script.Script{Subject: "webhooks", Name: "stripe", DedupKey: "Idempotency-Key"}
+
+	first := &executor.Message{Payload: []byte("a"), Headers: map[string]string{"idempotency-key": "42"}}
+	retried := &executor.Message{Payload: []byte("b"), Headers: map[string]string{"Idempotency-Key": "42"}}
+	assert.Equal(t, dedupKey(first, scr), dedupKey(retried, scr))
+
+	// Without the header, the message isn't deduplicated
+	assert.Equal(t, "", dedupKey(&executor.Message{Payload: []byte("a")}, scr))
+
+	scr.DedupKey = script.DEDUP_KEY_PAYLOAD
+	assert.NotEqual(t, dedupKey(first, scr), dedupKey(retried, scr))
+	assert.Equal(t, dedupKey(first, scr), dedupKey(&executor.Message{Payload: []byte("a")}, scr))
+}
+
+func TestRunDeduplicated(t *testing.T) {
+	ctx := context.Background()
+	store, err := msgstore.NewDevStore("")
+	assert.Nil(t, err)
+	h := &messageHandler{store: store}
+
+	scr := &script.Script{Subject: "webhooks", Name: "stripe", Delivery: script.DELIVERY_QUEUE, Dedup: time.Minute}
+	m := &executor.Message{Subject: "webhooks", Headers: map[string]string{script.DEDUP_KEY_MSG_ID: "42"}}
+
+	// A failed run doesn't keep the message
+	results := h.runDeduplicated(ctx, m, scr, func() []*executor.ScriptResult {
+		return []*executor.ScriptResult{{Name: scr.Name, Error: "failed"}}
+	})
+	assert.Equal(t, "failed", results[0].Error)
+
+	// The duplicates received while the message is handled aren't run
+	running := make(chan struct{})
+	finish := make(chan struct{})
+	done := make(chan []*executor.ScriptResult)
+	go func() {
+		done <- h.runDeduplicated(ctx, m, scr, func() []*executor.ScriptResult {
+			close(running)
+			<-finish
+			return []*executor.ScriptResult{{Name: scr.Name, Payload: []byte("first")}}
+		})
+	}()
+	<-running
+
+	run := func() []*executor.ScriptResult {
+		return []*executor.ScriptResult{{Name: scr.Name, Payload: []byte("second")}}
+	}
+	results = h.runDeduplicated(ctx, m, scr, run)
+	assert.Equal(t, (&executor.DuplicateInProgressError{}).Error(), results[0].Error)
+
+	close(finish)
+	assert.Equal(t, "first", string((<-done)[0].Payload))
+
+	// Then they get the results of the first run
+	results = h.runDeduplicated(ctx, m, scr, run)
+	assert.Equal(t, "first", string(results[0].Payload))
+
+	// Messages without the header are always run
+	results = h.runDeduplicated(ctx, &executor.Message{Subject: "webhooks"}, scr, run)
+	assert.Equal(t, "second", string(results[0].Payload))
+}
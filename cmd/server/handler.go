@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+// messageHandler runs the scripts registered to a subject when a message is received on it
+type messageHandler struct {
+	nc               *nats.Conn
+	js               jetstream.JetStream
+	store            msgstore.ScriptStore
+	executors        map[string]executor.Executor
+	defaultDelivery  string
+	deadLetterPrefix string
+	jobTTL           time.Duration
+	limits           *concurrencyLimiter
+	batches          *batcher
+	webhooks         *webhookDispatcher
+	cache            *resultCache
+	breakers         *circuitBreakers
+}
+
+func newMessageHandler(nc *nats.Conn, js jetstream.JetStream, store msgstore.ScriptStore, executors map[string]executor.Executor, defaultDelivery, deadLetterPrefix string, jobTTL time.Duration, limits *concurrencyLimiter, breakers *circuitBreakers, webhooks *webhookDispatcher) *messageHandler {
+	return &messageHandler{
+		nc:               nc,
+		js:               js,
+		store:            store,
+		executors:        executors,
+		defaultDelivery:  defaultDelivery,
+		deadLetterPrefix: deadLetterPrefix,
+		jobTTL:           jobTTL,
+		limits:           limits,
+		batches:          newBatcher(limits),
+		webhooks:         webhooks,
+		cache:            newResultCache(store),
+		breakers:         breakers,
+	}
+}
+
+// deliveryFor returns the delivery mode of the script, falling back on the server's default
+func (h *messageHandler) deliveryFor(scr *script.Script) string {
+	// Scripts bound to a stream are only triggered through their consumer
+	if scr.Stream != "" {
+		return script.DELIVERY_STREAM
+	}
+
+	// Batches are buffered by a single instance
+	if scr.Batch > 0 {
+		return script.DELIVERY_QUEUE
+	}
+
+	if scr.Delivery == "" {
+		return h.defaultDelivery
+	}
+
+	return scr.Delivery
+}
+
+// HandleMessage runs all the scripts registered under the subjects (or patterns) matching the one of the message
+// that are using the given delivery mode, and replies with all their results
+func (h *messageHandler) HandleMessage(patterns []string, delivery string, msg *nats.Msg) {
+	// Extract trace context from NATS message headers
+	ctx := otel.GetTextMapPropagator().Extract(
+		context.Background(),
+		natsHeaderCarrier(msg.Header),
+	)
+	ctx = withPipelineDepth(ctx, msg.Header)
+
+	// Start a span for the NATS message handling
+	ctx, span := mainTracer.Start(ctx, "nats.handle_message",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("nats.subject", msg.Subject),
+			attribute.StringSlice("nats.subscriptions", patterns),
+			attribute.String("nats.delivery", delivery),
+			attribute.Int("nats.message_size", len(msg.Data)),
+		),
+	)
+	defer span.End()
+
+	log.Debugf("Received message on subject: %s", msg.Subject)
+
+	m := executor.ParseMessage(msg.Subject, msg.Data, msg.Header)
+
+	fields := log.Fields{
+		"subject": m.Subject,
+		"raw":     m.Raw,
+		"async":   m.Async,
+	}
+
+	span.SetAttributes(
+		attribute.Bool("message.raw", m.Raw),
+		attribute.Bool("message.async", m.Async),
+	)
+
+	// Async messages are replied right away with the ID of the job keeping track of the scripts' reply
+	var job *Job
+	if m.Async {
+		span.SetAttributes(attribute.String("reply.mode", "async"))
+		job = h.startJob(ctx, m, newJobID(msg.Reply))
+		span.SetAttributes(attribute.String("job.id", job.ID))
+		fields["job"] = job.ID
+
+		rep, err := json.Marshal(&Reply{JobID: job.ID})
+		if err == nil && msg.Reply != "" {
+			err = h.nc.Publish(msg.Reply, rep)
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Failed to publish async reply")
+			log.WithFields(fields).Errorf("failed to reply to message: %v", err)
+
+			replyWithError(h.nc, fmt.Errorf("failed to reply to message: %v", err), msg.Reply)
+			return
+		}
+	} else {
+		span.SetAttributes(attribute.String("reply.mode", "sync"))
+
+		// The scripts are cancelled once the caller stops waiting for the reply
+		var cancel context.CancelFunc
+		ctx, cancel = withDeadlineHeader(ctx, msg.Header)
+		defer cancel()
+	}
+
+	cctx, getScriptsSpan := mainTracer.Start(ctx, "nats.handle_message.get_scripts", trace.WithAttributes(
+		attribute.StringSlice("script.patterns", patterns),
+		attribute.String("script.URL", m.URL),
+	))
+
+	// Each delivery mode has its own subscription, only keep the scripts for this one.
+	// The scripts are copied with their delivery mode resolved so the executors know if they need to lock.
+	scripts := make(map[string]*script.Script)
+	for _, pattern := range patterns {
+		allScripts, err := h.store.GetScripts(cctx, pattern)
+		if err != nil {
+			log.WithError(err).WithField("subject", pattern).Error("failed to get scripts for subject")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Failed to get scripts")
+			getScriptsSpan.End()
+
+			replyWithError(h.nc, fmt.Errorf("failed to get scripts for subject: %v", err), msg.Reply)
+			return
+		}
+
+		for name, scr := range allScripts {
+			if h.deliveryFor(scr) != delivery {
+				continue
+			}
+
+			s := *scr
+			s.Delivery = delivery
+			// Scripts of different patterns can share a name
+			scripts[strings.Join([]string{pattern, name}, "/")] = &s
+		}
+	}
+	getScriptsSpan.SetStatus(codes.Ok, fmt.Sprintf("found %d scripts", len(scripts)))
+	getScriptsSpan.End()
+
+	if len(scripts) == 0 {
+		span.SetStatus(codes.Ok, "No script found")
+		log.WithFields(fields).Debug("no script found for subject")
+
+		if job != nil {
+			h.finishJob(ctx, job, &Reply{Error: (&executor.NoScriptFoundError{}).Error()})
+		} else if msg.Reply != "" {
+			replyWithError(h.nc, &executor.NoScriptFoundError{}, msg.Reply)
+		}
+		return
+	}
+
+	msgRep := h.runScripts(ctx, m, scripts)
+	if job != nil {
+		h.finishJob(ctx, job, msgRep)
+		log.WithFields(fields).Debug("job finished")
+		span.SetStatus(codes.Ok, "Job finished")
+		return
+	}
+
+	_, natsReplaySpan := mainTracer.Start(ctx, "nats.handle_message.send_reply")
+	err := replyMessage(h.nc, m, msg.Reply, msgRep)
+	if err != nil {
+		natsReplaySpan.RecordError(err)
+		natsReplaySpan.SetStatus(codes.Error, "Failed to send reply through NATS")
+
+		log.WithError(err).Errorf("failed to send reply through NATS")
+		return
+	}
+
+	log.WithField("subject", msg.Subject).Debugf("finished running %d scripts", len(scripts))
+	span.SetStatus(codes.Ok, "Message handled")
+}
+
+// runScripts executes all the given scripts in parallel, except the middleware chain, and gathers their results in a Reply
+func (h *messageHandler) runScripts(ctx context.Context, m *executor.Message, scripts map[string]*script.Script) *Reply {
+	_, executeScriptsSpan := mainTracer.Start(ctx, "nats.handle_message.run_scripts")
+	defer executeScriptsSpan.End()
+
+	var wg sync.WaitGroup
+	parallel, steps := chainSteps(scripts)
+
+	allResults := make(chan *namedResults, len(parallel)+1)
+	for name, scr := range parallel {
+		wg.Add(1)
+
+		go func(ctx context.Context, msg *executor.Message, name string, scr *script.Script) {
+			defer wg.Done()
+
+			allResults <- &namedResults{name: name, results: h.runPipeline(ctx, msg, scr)}
+		}(ctx, m, name, scr)
+	}
+
+	// The scripts with an order run one after the other as a middleware chain, alongside the others
+	if len(steps) > 0 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			allResults <- &namedResults{name: steps[0].Name, results: h.runChain(ctx, m, steps)}
+		}()
+	}
+	wg.Wait()
+
+	close(allResults)
+
+	_, parseReplySpan := mainTracer.Start(ctx, "nats.handle_message.parse_replies")
+	var all []*namedResults
+	for nr := range allResults {
+		all = append(all, nr)
+	}
+
+	mode := aggregationFor(m, scripts)
+	parseReplySpan.SetAttributes(attribute.String("reply.aggregate", mode))
+
+	msgRep := new(Reply)
+	results, err := aggregateResults(mode, all)
+	if err != nil {
+		parseReplySpan.RecordError(err)
+		msgRep.Error = err.Error()
+	}
+
+	for _, res := range results {
+		if res.IsHTML {
+			msgRep.HTML = true
+		}
+
+		msgRep.Results = append(msgRep.Results, res)
+	}
+	parseReplySpan.SetAttributes(attribute.Int("responses", len(msgRep.Results)))
+	parseReplySpan.SetStatus(codes.Ok, "responses parsed")
+	parseReplySpan.End()
+
+	return msgRep
+}
+
+// runScript executes a single script with the executor it requires, retrying it as the script defines.
+// Broadcast scripts only run on the instance taking their lock. Messages that still fail after all the attempts, or that are rejected because too many scripts are running,
+// are sent to the dead-letter subject. Scripts over their rate limit are rejected without running them and cached
+// results are replied as-is. Scripts failing repeatedly are rejected by their circuit breaker until it cools down.
+func (h *messageHandler) runScript(ctx context.Context, m *executor.Message, scr *script.Script) *executor.ScriptResult {
+	// Pass the context with trace info to the executor
+	exec, err := executor.ExecutorByName(scr.Executor, h.executors)
+	if err != nil {
+		span := trace.SpanFromContext(ctx)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to get executor")
+		log.WithError(err).Error("failed to get executor for script")
+
+		return &executor.ScriptResult{Name: scr.Name, Error: fmt.Sprintf("failed to get executor for script: %v", err)}
+	}
+
+	// Cached results are replied without running the script
+	if scr.Cache > 0 {
+		res, hit := h.cache.get(ctx, m, scr)
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cache.hit", hit))
+		if hit {
+			log.WithField("subject", m.Subject).WithField("name", scr.Name).Debug("replying with cached result")
+			return res
+		}
+	}
+
+	// Every instance receives the messages of the broadcast scripts, only the one taking the lock runs the script.
+	// It's taken before the rate limit so the token is only taken once for the whole cluster.
+	if !scr.Exclusive() {
+		lockKey := executor.LockKey(scr)
+		locked, err := h.store.TakeLock(ctx, lockKey)
+		if err != nil {
+			span := trace.SpanFromContext(ctx)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Failed to acquire lock")
+			log.WithField("subject", m.Subject).WithField("name", scr.Name).Debugf("failed to get lock: %s", err)
+
+			return &executor.ScriptResult{Name: scr.Name, Error: fmt.Sprintf("failed to get lock: %s", err)}
+		}
+		if !locked {
+			log.WithField("subject", m.Subject).WithField("name", scr.Name).Debug("we don't have a lock, giving up")
+
+			return &executor.ScriptResult{Name: scr.Name, Error: (&executor.LockNotAcquiredError{}).Error()}
+		}
+		defer h.store.ReleaseLock(ctx, lockKey)
+
+		ctx = executor.WithLockHeld(ctx)
+	}
+
+	if scr.RateLimit.Enabled() {
+		wait := h.takeRateToken(ctx, scr)
+		if wait > 0 {
+			span := trace.SpanFromContext(ctx)
+			span.SetStatus(codes.Error, "Rate limited")
+			log.WithField("subject", m.Subject).WithField("name", scr.Name).Debugf("script rate limited, retry after %s", wait)
+
+			return rateLimitedResult(scr, wait)
+		}
+	}
+
+	// A batch takes its slot once it runs, the messages waiting in it don't hold one
+	batched := scr.Batch > 0 && scr.Delivery != script.DELIVERY_STREAM && !m.Scheduled
+	if h.limits != nil && !batched {
+		release, err := h.limits.acquire(ctx, scr)
+		if err != nil {
+			span := trace.SpanFromContext(ctx)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Script not allowed to run")
+			log.WithField("subject", m.Subject).WithField("name", scr.Name).Warnf("script not run: %v", err)
+
+			if scr.Delivery != script.DELIVERY_STREAM {
+				h.publishDeadLetter(ctx, m, scr, err.Error(), 0)
+			}
+
+			return &executor.ScriptResult{Name: scr.Name, Error: err.Error()}
+		}
+		defer release()
+	}
+
+	state, wait, allowed := h.breakers.allow(scr)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("breaker.state", state))
+	if !allowed {
+		err := &executor.CircuitOpenError{}
+		span := trace.SpanFromContext(ctx)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Circuit breaker open")
+		log.WithField("subject", m.Subject).WithField("name", scr.Name).Debugf("script not run: %v", err)
+
+		if scr.Delivery != script.DELIVERY_STREAM {
+			h.publishDeadLetter(ctx, m, scr, err.Error(), 0)
+		}
+
+		return circuitOpenResult(scr, wait)
+	}
+
+	var res *executor.ScriptResult
+	var attempts int
+	if batched {
+		res, attempts = h.batches.add(ctx, exec, m, scr), 1
+	} else {
+		res, attempts = executor.HandleMessageWithRetries(ctx, exec, m, scr)
+	}
+	if res.Name == "" {
+		res.Name = scr.Name
+	}
+	h.breakers.record(scr, res)
+
+	// Messages from a stream are redelivered by JetStream until they reach their maximum deliveries
+	if res.Error != "" && res.Error != (&executor.LockNotAcquiredError{}).Error() && scr.Delivery != script.DELIVERY_STREAM {
+		h.publishDeadLetter(ctx, m, scr, res.Error, attempts)
+	}
+
+	if scr.Cache > 0 && res.Error == "" {
+		h.cache.set(ctx, m, scr, res)
+	}
+
+	h.deliverWebhook(ctx, m, scr, res)
+
+	return res
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -128,12 +129,29 @@ func (fh *functionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Change the url passed to the fuction to remove the subject
 	url := strings.ReplaceAll(r.URL.String(), "/"+subject, "")
 	log.Debugf("URL: %s", url)
-	body, err := json.Marshal(&executor.Message{
-		Payload: payload,
-		Method:  r.Method,
-		Subject: subject,
-		URL:     url,
-	})
+	// The request's headers are passed to the scripts
+	headers := make(map[string]string)
+	for k, v := range r.Header {
+		headers[k] = strings.Join(v, ", ")
+	}
+
+	m := &executor.Message{
+		// The aggregation of the results can be chosen through the `_aggregate` query string
+		Aggregate: r.URL.Query().Get("_aggregate"),
+		Headers:   headers,
+		Payload:   payload,
+		Method:    r.Method,
+		Subject:   subject,
+		URL:       url,
+	}
+
+	// Passing the `_async` query string replies right away with a job that can be polled
+	if r.URL.Query().Has("_async") {
+		m.Async = true
+	}
+	span.SetAttributes(attribute.Bool("message.async", m.Async))
+
+	body, err := json.Marshal(m)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "Failed to encode message")
@@ -154,6 +172,8 @@ func (fh *functionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	msg := nats.NewMsg(subject)
 	msg.Data = body
 	otel.GetTextMapPropagator().Inject(ctx, natsHeaderCarrier(msg.Header))
+	// The scripts are cancelled when the timeout is reached
+	setDeadlineHeader(ctx, msg.Header)
 
 	// Send the message and wait for the response
 	response, err := fh.nc.RequestMsgWithContext(ctx, msg)
@@ -162,6 +182,16 @@ func (fh *functionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		natsSpan.SetStatus(codes.Error, "NATS request failed")
 		natsSpan.End()
 
+		// Nobody is subscribed to that subject, meaning no script is registered for it
+		if errors.Is(err, nats.ErrNoResponders) {
+			span.SetStatus(codes.Error, "Script not found")
+			span.SetAttributes(attribute.Int("http.status_code", http.StatusNotFound))
+
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Error: " + (&executor.NoScriptFoundError{}).Error()))
+			return
+		}
+
 		span.SetStatus(codes.Error, "Service unavailable")
 		span.SetAttributes(attribute.Int("http.status_code", http.StatusServiceUnavailable))
 
@@ -204,6 +234,50 @@ func (fh *functionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Every script was rejected by its rate limit
+	if retryAfter, limited := rateLimited(rep.Results); limited {
+		span.SetStatus(codes.Error, "Rate limited")
+		span.SetAttributes(attribute.Int("http.status_code", http.StatusTooManyRequests))
+		w.Header().Set(RETRY_AFTER_HEADER, retryAfter)
+		w.WriteHeader(http.StatusTooManyRequests)
+
+		_, err = w.Write([]byte("Error: " + (&executor.RateLimitedError{}).Error()))
+		if err != nil {
+			log.WithFields(fields).Errorf("failed to write error to HTTP response: %v", err)
+		}
+
+		return
+	}
+
+	// Every script was rejected by its circuit breaker
+	if retryAfter, open := circuitOpen(rep.Results); open {
+		span.SetStatus(codes.Error, "Circuit breaker open")
+		span.SetAttributes(attribute.Int("http.status_code", http.StatusServiceUnavailable))
+		w.Header().Set(RETRY_AFTER_HEADER, retryAfter)
+		w.WriteHeader(http.StatusServiceUnavailable)
+
+		_, err = w.Write([]byte("Error: " + (&executor.CircuitOpenError{}).Error()))
+		if err != nil {
+			log.WithFields(fields).Errorf("failed to write error to HTTP response: %v", err)
+		}
+
+		return
+	}
+
+	// Every script was rejected because the server is too busy
+	if overloaded(rep.Results) {
+		span.SetStatus(codes.Error, "Overloaded")
+		span.SetAttributes(attribute.Int("http.status_code", http.StatusTooManyRequests))
+		w.WriteHeader(http.StatusTooManyRequests)
+
+		_, err = w.Write([]byte("Error: " + (&executor.OverloadedError{}).Error()))
+		if err != nil {
+			log.WithFields(fields).Errorf("failed to write error to HTTP response: %v", err)
+		}
+
+		return
+	}
+
 	// Go through all the scripts to see if one is HTML
 	for _, scrRes := range rep.Results {
 		if scrRes.IsHTML {
@@ -237,6 +311,44 @@ func (fh *functionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if rep.JobID != "" {
+		span.SetAttributes(
+			attribute.String("job.id", rep.JobID),
+			attribute.Int("http.status_code", http.StatusAccepted),
+		)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/_/jobs/"+rep.JobID)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"job_id":%q}`, rep.JobID)
+
+		span.SetStatus(codes.Ok, "")
+		return
+	}
+
+	// A single script returning a HTTP status (like a middleware chain being stopped) is replied as-is
+	if len(rep.Results) == 1 && rep.Results[0].HTTPStatus && rep.Results[0].Code >= 100 && rep.Results[0].Code <= 999 {
+		scrRes := rep.Results[0]
+		for k, v := range scrRes.Headers {
+			w.Header().Add(k, v)
+		}
+		span.SetAttributes(
+			attribute.Bool("response.is_html", false),
+			attribute.Int("http.status_code", scrRes.Code),
+			attribute.Int("http.response.body_size", len(scrRes.Payload)),
+		)
+		w.WriteHeader(scrRes.Code)
+
+		_, err = w.Write(scrRes.Payload)
+		if err != nil {
+			span.RecordError(err)
+			log.WithFields(fields).Errorf("failed to write reply back to HTTP response: %v", err)
+		}
+
+		span.SetStatus(codes.Ok, "")
+		return
+	}
+
 	// Convert the results to bytes
 	span.SetAttributes(attribute.Bool("response.is_html", false))
 	rr, err := json.Marshal(rep.Results)
@@ -275,6 +387,7 @@ func runHTTP(port int, backend string, natsURL string) {
 	r.HandleFunc("/_/list", hfunc.ListScripts)
 	r.HandleFunc("/_/subject/{subject}", hfunc.ListNamesForScript)
 	r.HandleFunc("/_/info/{subject}/{name}", hfunc.InfoForNamedScript)
+	r.HandleFunc("/_/jobs/{id}", hfunc.JobStatus)
 
 	r.PathPrefix("/").Handler(hfunc)
 
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"sort"
@@ -118,15 +120,65 @@ func (fh *functionHandler) InfoForNamedScript(w http.ResponseWriter, r *http.Req
 
 	w.WriteHeader(http.StatusOK)
 	err = fh.templates["info"].ExecuteTemplate(w, "info", map[string]any{
-		"subject":     subject,
-		"name":        name,
-		"isHTMLValue": script.IsHTML,
-		"libraries":   script.Headers["libraries"],
-		"executor":    script.Headers["executor"],
-		"content":     string(script.Payload),
+		"subject":         subject,
+		"name":            name,
+		"isHTMLValue":     script.IsHTML,
+		"libraries":       script.Headers["libraries"],
+		"executor":        script.Headers["executor"],
+		"schedule":        script.Headers["schedule"],
+		"lastRun":         script.Headers["last_run"],
+		"lastError":       script.Headers["last_error"],
+		"nextRuns":        script.Headers["next_runs"],
+		"breakerState":    script.Headers["breaker_state"],
+		"breakerFailures": script.Headers["breaker_failures"],
+		"breakerOpenedAt": script.Headers["breaker_opened_at"],
+		"content":         string(script.Payload),
 	})
 	if err != nil {
 		returnError(w, err)
 		return
 	}
 }
+
+func (fh *functionHandler) JobStatus(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	msg := nats.NewMsg(subjectJobStatus)
+	msg.Data = []byte(id)
+
+	ctx, cancel := context.WithTimeout(r.Context(), JOB_STATUS_TIMEOUT)
+	defer cancel()
+
+	// None of the instances replying means none of them has the job
+	response, err := fh.nc.RequestMsgWithContext(ctx, msg)
+	if errors.Is(err, context.DeadlineExceeded) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Error: " + (&JobNotFoundError{}).Error()))
+		return
+	}
+	if err != nil {
+		returnError(w, err)
+		return
+	}
+
+	rep := &Reply{}
+	err = json.Unmarshal(response.Data, rep)
+	if err != nil {
+		returnError(w, err)
+		return
+	}
+
+	if rep.Error == (&JobNotFoundError{}).Error() {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Error: " + rep.Error))
+		return
+	}
+	if rep.Error != "" || len(rep.Results) < 1 {
+		returnError(w, fmt.Errorf("failed to get job %s: %s", id, rep.Error))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(rep.Results[0].Payload)
+}
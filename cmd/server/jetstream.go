@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+const (
+	STREAM_CONSUMER_PREFIX = "msgscript"
+	STREAM_NAK_MIN_DELAY   = 1 * time.Second
+	STREAM_NAK_MAX_DELAY   = 1 * time.Minute
+	// How long JetStream waits for a message to be acked before redelivering it. The scripts running for longer
+	// tell it that they're still working on it every third of that time.
+	STREAM_ACK_WAIT = 30 * time.Second
+)
+
+// ensureWorkQueueStream creates the stream with the work queue retention, removing the messages once they're acked
+// or deleted, or updates it when it already exists. The retention of a stream can't be changed once it's created,
+// so the streams created with another one are left as they are until they're deleted.
+func ensureWorkQueueStream(ctx context.Context, js jetstream.JetStream, cfg jetstream.StreamConfig) error {
+	cfg.Retention = jetstream.WorkQueuePolicy
+
+	stream, err := js.Stream(ctx, cfg.Name)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		_, err = js.CreateStream(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create stream %s: %w", cfg.Name, err)
+		}
+
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get stream %s: %w", cfg.Name, err)
+	}
+
+	current := stream.CachedInfo().Config
+	if current.Retention != cfg.Retention {
+		log.WithField("stream", cfg.Name).Warnf("stream has the %s retention, delete it to have the messages removed once handled", current.Retention)
+		cfg.Retention = current.Retention
+	}
+
+	// Keep the settings changed on the stream itself
+	current.Subjects = cfg.Subjects
+	current.MaxAge = cfg.MaxAge
+	current.Retention = cfg.Retention
+	_, err = js.UpdateStream(ctx, current)
+	if err != nil {
+		return fmt.Errorf("failed to update stream %s: %w", cfg.Name, err)
+	}
+
+	return nil
+}
+
+type streamConsumer struct {
+	config  string
+	consume jetstream.ConsumeContext
+}
+
+// streamManager keeps a JetStream durable pull consumer for each script bound to a stream
+type streamManager struct {
+	mu        sync.Mutex
+	js        jetstream.JetStream
+	handler   *messageHandler
+	consumers map[string]*streamConsumer
+}
+
+func newStreamManager(js jetstream.JetStream, handler *messageHandler) *streamManager {
+	return &streamManager{
+		js:        js,
+		handler:   handler,
+		consumers: make(map[string]*streamConsumer),
+	}
+}
+
+func streamConsumerKey(subject, name string) string {
+	return strings.Join([]string{subject, name}, "/")
+}
+
+// streamConsumerName returns the durable name of the consumer, generating one from the subject and name if
+// the script doesn't define it
+func streamConsumerName(subject string, scr *script.Script) string {
+	if scr.Consumer != "" {
+		return scr.Consumer
+	}
+
+	// Durable names cannot contain any of these characters
+	r := strings.NewReplacer(".", "_", "*", "_", ">", "_", "/", "_", " ", "_", "\t", "_")
+	return r.Replace(strings.Join([]string{STREAM_CONSUMER_PREFIX, subject, scr.Name}, "_"))
+}
+
+// streamNakDelay returns the delay before the message is redelivered, doubling for each delivery
+func streamNakDelay(delivered uint64) time.Duration {
+	delay := STREAM_NAK_MIN_DELAY
+	for i := uint64(1); i < delivered && delay < STREAM_NAK_MAX_DELAY; i++ {
+		delay *= 2
+	}
+
+	return min(delay, STREAM_NAK_MAX_DELAY)
+}
+
+// refresh starts, restarts or stops the consumers of the subject so they match the scripts bound to a stream
+func (st *streamManager) refresh(ctx context.Context, subject string, scripts map[string]*script.Script) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	wanted := make(map[string]*script.Script)
+	for name, scr := range scripts {
+		if scr.Stream != "" {
+			wanted[streamConsumerKey(subject, name)] = scr
+		}
+	}
+
+	// Stop the consumers that aren't needed anymore or have their configuration changed
+	for key, cons := range st.consumers {
+		if !strings.HasPrefix(key, subject+"/") {
+			continue
+		}
+
+		scr, found := wanted[key]
+		if found && cons.config == streamConsumerConfig(subject, scr) {
+			continue
+		}
+
+		cons.consume.Stop()
+		delete(st.consumers, key)
+		log.WithField("subject", subject).WithField("key", key).Info("stopped stream consumer")
+	}
+
+	for key, scr := range wanted {
+		if _, found := st.consumers[key]; found {
+			continue
+		}
+
+		name := strings.TrimPrefix(key, subject+"/")
+		cons, err := st.consume(ctx, subject, name, scr)
+		if err != nil {
+			log.WithField("subject", subject).WithField("stream", scr.Stream).Errorf("failed to start stream consumer: %v", err)
+			continue
+		}
+
+		st.consumers[key] = cons
+	}
+}
+
+func streamConsumerConfig(subject string, scr *script.Script) string {
+	return fmt.Sprintf("%s|%s|%d", scr.Stream, streamConsumerName(subject, scr), scr.MaxDeliver)
+}
+
+func (st *streamManager) consume(ctx context.Context, subject, name string, scr *script.Script) (*streamConsumer, error) {
+	fields := log.Fields{
+		"subject": subject,
+		"stream":  scr.Stream,
+	}
+
+	// Create the stream if it doesn't exist yet
+	_, err := st.js.Stream(ctx, scr.Stream)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		_, err = st.js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:     scr.Stream,
+			Subjects: []string{subject},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stream %s: %w", scr.Stream, err)
+		}
+
+		log.WithFields(fields).Info("created stream")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get stream %s: %w", scr.Stream, err)
+	}
+
+	durable := streamConsumerName(subject, scr)
+	cfg := jetstream.ConsumerConfig{
+		Durable:       durable,
+		FilterSubject: subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       STREAM_ACK_WAIT,
+	}
+	if scr.MaxDeliver > 0 {
+		cfg.MaxDeliver = scr.MaxDeliver
+	}
+
+	consumer, err := st.js.CreateOrUpdateConsumer(ctx, scr.Stream, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer %s: %w", durable, err)
+	}
+
+	cc, err := consumer.Consume(func(msg jetstream.Msg) {
+		st.handler.HandleStreamMessage(subject, name, msg)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume from %s: %w", durable, err)
+	}
+
+	log.WithFields(fields).WithField("consumer", durable).Info("started stream consumer")
+
+	return &streamConsumer{
+		config:  streamConsumerConfig(subject, scr),
+		consume: cc,
+	}, nil
+}
+
+// Stop stops all the consumers
+func (st *streamManager) Stop() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for key, cons := range st.consumers {
+		cons.consume.Stop()
+		delete(st.consumers, key)
+	}
+}
+
+// streamInProgress keeps telling JetStream that the message is being worked on, so it isn't redelivered to another
+// instance while the script runs for longer than the ack wait. The returned function stops it.
+func streamInProgress(msg jetstream.Msg, fields log.Fields) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(STREAM_ACK_WAIT / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := msg.InProgress()
+				if err != nil {
+					log.WithFields(fields).Errorf("failed to mark message in progress: %v", err)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// HandleStreamMessage runs the named script for a message received from its stream consumer.
+// The message is acknowledged if the script succeeded, otherwise it is redelivered after a delay.
+func (h *messageHandler) HandleStreamMessage(subject, name string, msg jetstream.Msg) {
+	ctx := otel.GetTextMapPropagator().Extract(
+		context.Background(),
+		natsHeaderCarrier(msg.Headers()),
+	)
+	ctx = withPipelineDepth(ctx, msg.Headers())
+
+	ctx, span := mainTracer.Start(ctx, "jetstream.handle_message",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("nats.subject", msg.Subject()),
+			attribute.String("nats.subscription", subject),
+			attribute.String("script.name", name),
+			attribute.Int("nats.message_size", len(msg.Data())),
+		),
+	)
+	defer span.End()
+
+	fields := log.Fields{
+		"subject": msg.Subject(),
+		"name":    name,
+	}
+
+	var delivered uint64 = 1
+	meta, err := msg.Metadata()
+	if err == nil {
+		delivered = meta.NumDelivered
+	}
+	span.SetAttributes(attribute.Int64("jetstream.delivered", int64(delivered)))
+
+	scripts, err := h.store.GetScripts(ctx, subject)
+	scr, found := scripts[name]
+	if err != nil || !found {
+		span.SetStatus(codes.Error, "Script not found")
+		log.WithFields(fields).Error("failed to find script for stream message")
+
+		msg.NakWithDelay(streamNakDelay(delivered))
+		return
+	}
+
+	s := *scr
+	s.Delivery = script.DELIVERY_STREAM
+
+	m := executor.ParseMessage(msg.Subject(), msg.Data(), msg.Headers())
+	stopProgress := streamInProgress(msg, fields)
+	resErr := pipelineError(h.runPipeline(ctx, m, &s))
+	stopProgress()
+	if resErr != "" {
+		span.SetStatus(codes.Error, resErr)
+
+		// This was the last delivery, JetStream won't send the message again
+		if s.MaxDeliver > 0 && delivered >= uint64(s.MaxDeliver) {
+			log.WithFields(fields).WithField("delivered", delivered).Errorf("script failed on its last delivery: %s", resErr)
+			h.publishDeadLetter(ctx, m, &s, resErr, int(delivered))
+
+			err = msg.Term()
+			if err != nil {
+				log.WithFields(fields).Errorf("failed to terminate message: %v", err)
+			}
+			return
+		}
+
+		log.WithFields(fields).WithField("delivered", delivered).Errorf("script failed, message will be redelivered: %s", resErr)
+
+		err = msg.NakWithDelay(streamNakDelay(delivered))
+		if err != nil {
+			log.WithFields(fields).Errorf("failed to nak message: %v", err)
+		}
+		return
+	}
+
+	err = msg.Ack()
+	if err != nil {
+		span.RecordError(err)
+		log.WithFields(fields).Errorf("failed to ack message: %v", err)
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Message acknowledged")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+// startTestNats starts an embedded NATS server with JetStream, stopped at the end of the test
+func startTestNats(t *testing.T) (*nats.Conn, jetstream.JetStream) {
+	ns, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	assert.Nil(t, err)
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+	assert.True(t, ns.ReadyForConnections(5*time.Second))
+
+	nc, err := nats.Connect(ns.ClientURL())
+	assert.Nil(t, err)
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	assert.Nil(t, err)
+
+	return nc, js
+}
+
+// newTestHandler returns a message handler running every script with the executor
+func newTestHandler(t *testing.T, nc *nats.Conn, js jetstream.JetStream, exec executor.Executor, deadLetterPrefix string) (*messageHandler, msgstore.ScriptStore) {
+	store, err := msgstore.NewDevStore("")
+	assert.Nil(t, err)
+
+	executors := map[string]executor.Executor{executor.EXECUTOR_LUA_NAME: exec}
+	return newMessageHandler(nc, js, store, executors, script.DELIVERY_BROADCAST, deadLetterPrefix, DEFAULT_JOB_TTL, newConcurrencyLimiter(0, 10), newCircuitBreakers(0, 0), nil), store
+}
+
+// flakyExecutor fails the given number of runs before replying with the payload of the message
+type flakyExecutor struct {
+	failures int32
+	runs     atomic.Int32
+}
+
+func (e *flakyExecutor) HandleMessage(ctx context.Context, msg *executor.Message, scr *script.Script) *executor.ScriptResult {
+	if e.runs.Add(1) <= e.failures {
+		return &executor.ScriptResult{Error: "downstream is down"}
+	}
+
+	return &executor.ScriptResult{Payload: msg.Payload}
+}
+
+func (e *flakyExecutor) HandleBatch(ctx context.Context, msgs []*executor.Message, scr *script.Script) []*executor.ScriptResult {
+	var results []*executor.ScriptResult
+	for _, msg := range msgs {
+		results = append(results, e.HandleMessage(ctx, msg, scr))
+	}
+	return results
+}
+
+func (e *flakyExecutor) Stop() {}
+
+func TestHandleStreamMessage(t *testing.T) {
+	ctx := context.Background()
+	nc, js := startTestNats(t)
+	exec := &flakyExecutor{failures: 1}
+	h, store := newTestHandler(t, nc, js, exec, "")
+
+	scr := &script.Script{Subject: "orders", Name: "process", Stream: "ORDERS"}
+	store.AddScript(ctx, "orders", "process", scr)
+	scripts, _ := store.GetScripts(ctx, "orders")
+
+	streams := newStreamManager(js, h)
+	streams.refresh(ctx, "orders", scripts)
+	defer streams.Stop()
+
+	_, err := js.Publish(ctx, "orders", []byte("order"))
+	assert.Nil(t, err)
+
+	// The failed run naks the message, it's redelivered after the delay and acked once the script succeeds
+	assert.Eventually(t, func() bool { return exec.runs.Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	consumer, err := js.Consumer(ctx, "ORDERS", streamConsumerName("orders", scr))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		info, err := consumer.Info(ctx)
+		return err == nil && info.NumAckPending == 0 && info.AckFloor.Stream == 1
+	}, time.Second, 10*time.Millisecond)
+
+	info, err := consumer.Info(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), info.Delivered.Consumer)
+	assert.Equal(t, int32(2), exec.runs.Load())
+}
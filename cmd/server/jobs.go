@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/numkem/msgscript/executor"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+const (
+	JOB_KEY_PREFIX  = "jobs"
+	DEFAULT_JOB_TTL = 24 * time.Hour
+	// How long the instances are waited on for the status of a job
+	JOB_STATUS_TIMEOUT = 5 * time.Second
+)
+
+// Statuses of an async job
+const (
+	JOB_STATUS_RUNNING   = "running"
+	JOB_STATUS_COMPLETED = "completed"
+	JOB_STATUS_FAILED    = "failed"
+)
+
+// Job keeps track of an async message and the reply of its scripts once they finished
+type Job struct {
+	CreatedAt  time.Time `json:"created_at"`
+	DurationMs int64     `json:"duration_ms"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+	ID         string    `json:"id"`
+	Reply      *Reply    `json:"reply,omitempty"`
+	Status     string    `json:"status"`
+	Subject    string    `json:"subject"`
+}
+
+func jobKey(id string) string {
+	return strings.Join([]string{JOB_KEY_PREFIX, id}, "/")
+}
+
+// newJobID returns the ID of the job of a message, it's derived from the reply subject so every instance receiving
+// the message in broadcast delivery replies with the same ID, whichever one runs the scripts. Clients can't choose
+// the ID, it would let them overwrite the job of another message.
+func newJobID(replySubject string) string {
+	if replySubject != "" {
+		return uuid.NewSHA1(uuid.NameSpaceOID, []byte(replySubject)).String()
+	}
+
+	return uuid.New().String()
+}
+
+func saveJob(ctx context.Context, store msgstore.ScriptStore, job *Job, ttl time.Duration) error {
+	j, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to encode job %s: %w", job.ID, err)
+	}
+
+	err = store.SetValue(ctx, jobKey(job.ID), j, ttl)
+	if err != nil {
+		return fmt.Errorf("failed to save job %s: %w", job.ID, err)
+	}
+
+	return nil
+}
+
+func loadJob(ctx context.Context, store msgstore.ScriptStore, id string) (*Job, error) {
+	j, err := store.GetValue(ctx, jobKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job %s: %w", id, err)
+	}
+	if j == nil {
+		return nil, nil
+	}
+
+	job := new(Job)
+	err = json.Unmarshal(j, job)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode job %s: %w", id, err)
+	}
+
+	return job, nil
+}
+
+// startJob saves the job as running
+func (h *messageHandler) startJob(ctx context.Context, m *executor.Message, id string) *Job {
+	job := &Job{
+		CreatedAt: time.Now(),
+		ID:        id,
+		Status:    JOB_STATUS_RUNNING,
+		Subject:   m.Subject,
+	}
+
+	// Another instance might have already started, or even finished, the job. It's only saved when it doesn't
+	// exist so a finished job isn't marked as running again.
+	err := h.store.UpdateValue(ctx, jobKey(id), h.jobTTL, func(value []byte) ([]byte, error) {
+		if value != nil {
+			existing := new(Job)
+			if json.Unmarshal(value, existing) == nil {
+				job = existing
+			}
+			return value, nil
+		}
+
+		return json.Marshal(job)
+	})
+	if err != nil {
+		log.WithField("subject", m.Subject).WithField("job", id).Errorf("failed to start job: %v", err)
+	}
+
+	return job
+}
+
+// finishJob saves the reply of the scripts along with the status of the job
+func (h *messageHandler) finishJob(ctx context.Context, job *Job, rep *Reply) {
+	// With broadcast delivery, the instances that didn't get the lock don't own the job
+	if lockedOut(rep) {
+		return
+	}
+
+	job.FinishedAt = time.Now()
+	job.DurationMs = job.FinishedAt.Sub(job.CreatedAt).Milliseconds()
+	job.Reply = rep
+	job.Status = JOB_STATUS_COMPLETED
+	if rep.Error != "" || pipelineError(rep.Results) != "" {
+		job.Status = JOB_STATUS_FAILED
+	}
+
+	err := saveJob(ctx, h.store, job, h.jobTTL)
+	if err != nil {
+		log.WithField("subject", job.Subject).WithField("job", job.ID).Errorf("failed to finish job: %v", err)
+	}
+}
+
+// lockedOut tells if none of the scripts ran because another instance has the lock
+func lockedOut(rep *Reply) bool {
+	if rep.Error != "" || len(rep.Results) == 0 {
+		return false
+	}
+
+	for _, res := range rep.Results {
+		if res.Error != (&executor.LockNotAcquiredError{}).Error() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func replyWithJobStatus(ctx context.Context, nc *nats.Conn, scriptStore msgstore.ScriptStore, id, replySubject string) {
+	job, err := loadJob(ctx, scriptStore, id)
+	if err != nil {
+		replyWithError(nc, err, replySubject)
+		return
+	}
+	if job == nil {
+		// Without a shared store, each instance only knows its own jobs. The instance having the job replies,
+		// the requester gives up once the status timeout is reached when none of them does.
+		if scriptStore.BackendName() == msgstore.ETCD_BACKEND_NAME {
+			replyWithError(nc, &JobNotFoundError{}, replySubject)
+		}
+		return
+	}
+
+	j, err := json.Marshal(job)
+	if err != nil {
+		replyWithError(nc, fmt.Errorf("failed to encode job: %v", err), replySubject)
+		return
+	}
+
+	replyMessage(nc, &executor.Message{}, replySubject, &Reply{
+		Results: []*executor.ScriptResult{
+			{
+				Code:       http.StatusOK,
+				Error:      "",
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Payload:    j,
+				HTTPStatus: true,
+			},
+		},
+	})
+}
+
+type JobNotFoundError struct{}
+
+func (e *JobNotFoundError) Error() string {
+	return "Job not found"
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/numkem/msgscript/executor"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+func TestStartJob(t *testing.T) {
+	ctx := context.Background()
+	store, err := msgstore.NewDevStore("")
+	assert.Nil(t, err)
+
+	// Every instance derives the same ID from the message
+	m := &executor.Message{Subject: "work", Async: true}
+	id := newJobID("_INBOX.abc")
+	assert.Equal(t, id, newJobID("_INBOX.abc"))
+	assert.NotEqual(t, id, newJobID("_INBOX.def"))
+
+	h := &messageHandler{store: store, jobTTL: DEFAULT_JOB_TTL}
+	job := h.startJob(ctx, m, id)
+	h.finishJob(ctx, job, &Reply{Results: []*executor.ScriptResult{{Payload: []byte("done")}}})
+
+	// An instance starting the job late doesn't mark it as running again
+	job = h.startJob(ctx, m, id)
+	assert.Equal(t, JOB_STATUS_COMPLETED, job.Status)
+
+	saved, err := loadJob(ctx, store, id)
+	assert.Nil(t, err)
+	assert.Equal(t, JOB_STATUS_COMPLETED, saved.Status)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+const (
+	// Maximum number of scripts running at once on the server, 0 means no limit
+	DEFAULT_MAX_CONCURRENCY = 0
+	// Maximum number of scripts waiting for a slot before being rejected
+	DEFAULT_WAIT_QUEUE_SIZE = 100
+)
+
+// semaphore hands out a fixed number of slots, keeping track of how many are waiting for one
+type semaphore struct {
+	mu      sync.Mutex
+	slots   chan struct{}
+	waiting int
+}
+
+func newSemaphore(size int) *semaphore {
+	return &semaphore{slots: make(chan struct{}, size)}
+}
+
+// acquire takes a slot, waiting for one to be released if they are all used. The script is rejected with an
+// OverloadedError if there are already maxWaiting others waiting.
+func (s *semaphore) acquire(ctx context.Context, maxWaiting int) error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	s.mu.Lock()
+	if s.waiting >= maxWaiting {
+		s.mu.Unlock()
+		return &executor.OverloadedError{}
+	}
+	s.waiting++
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.waiting--
+		s.mu.Unlock()
+	}()
+
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *semaphore) release() {
+	<-s.slots
+}
+
+// concurrencyLimiter bounds how many scripts run at once, both for the whole server and for each script
+// defining a concurrency
+type concurrencyLimiter struct {
+	mu         sync.Mutex
+	global     *semaphore
+	maxWaiting int
+	scripts    map[string]*semaphore
+}
+
+func newConcurrencyLimiter(maxConcurrency, maxWaiting int) *concurrencyLimiter {
+	l := &concurrencyLimiter{
+		maxWaiting: maxWaiting,
+		scripts:    make(map[string]*semaphore),
+	}
+	if maxConcurrency > 0 {
+		l.global = newSemaphore(maxConcurrency)
+	}
+
+	return l
+}
+
+// scriptSemaphore returns the semaphore of the script, replacing it when its concurrency changed
+func (l *concurrencyLimiter) scriptSemaphore(scr *script.Script) *semaphore {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := strings.Join([]string{scr.Subject, scr.Name}, "/")
+	sem, found := l.scripts[key]
+	if !found || cap(sem.slots) != scr.Concurrency {
+		sem = newSemaphore(scr.Concurrency)
+		l.scripts[key] = sem
+	}
+
+	return sem
+}
+
+// acquire waits for the script to be allowed to run. The returned function must be called once the script is done.
+func (l *concurrencyLimiter) acquire(ctx context.Context, scr *script.Script) (func(), error) {
+	var sems []*semaphore
+	if scr.Concurrency > 0 {
+		sems = append(sems, l.scriptSemaphore(scr))
+	}
+	if l.global != nil {
+		sems = append(sems, l.global)
+	}
+
+	release := func() {
+		for _, sem := range sems {
+			sem.release()
+		}
+	}
+
+	// The script's own slot is taken first so a script waiting on itself doesn't hold a server slot
+	for i, sem := range sems {
+		err := sem.acquire(ctx, l.maxWaiting)
+		if err != nil {
+			for _, s := range sems[:i] {
+				s.release()
+			}
+
+			return nil, err
+		}
+	}
+
+	return release, nil
+}
+
+// overloaded tells if all the scripts were rejected because too many scripts were running
+func overloaded(results []*executor.ScriptResult) bool {
+	if len(results) == 0 {
+		return false
+	}
+
+	for _, res := range results {
+		if res.Error != (&executor.OverloadedError{}).Error() {
+			return false
+		}
+	}
+
+	return true
+}
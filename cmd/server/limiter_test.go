@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+func TestConcurrencyLimiterScript(t *testing.T) {
+	l := newConcurrencyLimiter(0, 1)
+	scr := &script.Script{Subject: "test", Name: "limited", Concurrency: 1}
+
+	release, err := l.acquire(context.Background(), scr)
+	assert.Nil(t, err)
+
+	// The second one waits for the slot
+	acquired := make(chan func())
+	go func() {
+		r, err := l.acquire(context.Background(), scr)
+		assert.Nil(t, err)
+		acquired <- r
+	}()
+
+	sem := l.scriptSemaphore(scr)
+	assert.Eventually(t, func() bool {
+		sem.mu.Lock()
+		defer sem.mu.Unlock()
+		return sem.waiting == 1
+	}, time.Second, time.Millisecond)
+
+	// The wait queue is full
+	_, err = l.acquire(context.Background(), scr)
+	assert.Equal(t, (&executor.OverloadedError{}).Error(), err.Error())
+
+	release()
+	(<-acquired)()
+}
+
+func TestConcurrencyLimiterCancelled(t *testing.T) {
+	l := newConcurrencyLimiter(1, 10)
+	scr := &script.Script{Subject: "test", Name: "unlimited"}
+
+	release, err := l.acquire(context.Background(), scr)
+	assert.Nil(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = l.acquire(ctx, scr)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// batchExecutor replies to each message of a batch with its payload
+type batchExecutor struct{}
+
+func (batchExecutor) HandleMessage(ctx context.Context, msg *executor.Message, scr *script.Script) *executor.ScriptResult {
+	return &executor.ScriptResult{Payload: msg.Payload}
+}
+
+func (batchExecutor) HandleBatch(ctx context.Context, msgs []*executor.Message, scr *script.Script) []*executor.ScriptResult {
+	var results []*executor.ScriptResult
+	for _, msg := range msgs {
+		results = append(results, &executor.ScriptResult{Payload: msg.Payload})
+	}
+	return results
+}
+
+func (batchExecutor) Stop() {}
+
+func TestBatcherConcurrency(t *testing.T) {
+	l := newConcurrencyLimiter(0, 1)
+	b := newBatcher(l)
+	scr := &script.Script{Subject: "test", Name: "batched", Concurrency: 1, Batch: 2, BatchWindow: time.Minute}
+	sem := l.scriptSemaphore(scr)
+
+	release, err := l.acquire(context.Background(), scr)
+	assert.Nil(t, err)
+
+	results := make(chan *executor.ScriptResult, 2)
+	add := func(payload string) {
+		go func() {
+			results <- b.add(context.Background(), batchExecutor{}, &executor.Message{Payload: []byte(payload)}, scr)
+		}()
+	}
+
+	// The message waiting in the batch doesn't wait for a slot
+	add("a")
+	assert.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.batches) == 1 && len(b.batches["test/batched"].msgs) == 1
+	}, time.Second, time.Millisecond)
+	sem.mu.Lock()
+	assert.Equal(t, 0, sem.waiting)
+	sem.mu.Unlock()
+
+	// The full batch waits for one
+	add("b")
+	assert.Eventually(t, func() bool {
+		sem.mu.Lock()
+		defer sem.mu.Unlock()
+		return sem.waiting == 1
+	}, time.Second, time.Millisecond)
+
+	release()
+	payloads := []string{string((<-results).Payload), string((<-results).Payload)}
+	assert.ElementsMatch(t, []string{"a", "b"}, payloads)
+	assert.Len(t, sem.slots, 0)
+}
@@ -1,26 +1,21 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"flag"
-	"fmt"
 	"os"
 	"os/signal"
-	"strings"
-	"sync"
+	"path/filepath"
 	"syscall"
 	"time"
 
 	natsserver "github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/codes"
-	"go.opentelemetry.io/otel/trace"
 
 	"github.com/numkem/msgscript"
 	"github.com/numkem/msgscript/executor"
@@ -42,6 +37,23 @@ func main() {
 	pluginDir := flag.String("plugin", "", "Plugin directory")
 	libraryDir := flag.String("library", "", "Library directory")
 	scriptDir := flag.String("script", ".", "Script directory")
+	delivery := flag.String("delivery", script.DELIVERY_BROADCAST, "Default delivery mode of the scripts (broadcast, queue)")
+	queueGroup := flag.String("queue", DEFAULT_QUEUE_GROUP, "Name of the NATS queue group used by scripts in queue delivery mode")
+	deadLetterPrefix := flag.String("dlq", executor.DEFAULT_DEAD_LETTER_PREFIX, "Subject prefix where the messages of failed scripts are published, empty to disable")
+	jobTTL := flag.Duration("jobttl", DEFAULT_JOB_TTL, "How long the status and reply of async jobs are kept")
+	maxConcurrency := flag.Int("concurrency", DEFAULT_MAX_CONCURRENCY, "Maximum number of scripts running at once, 0 for no limit")
+	waitQueueSize := flag.Int("waitqueue", DEFAULT_WAIT_QUEUE_SIZE, "Maximum number of scripts waiting for a free slot before being rejected")
+	breakerThreshold := flag.Int("breakerthreshold", DEFAULT_BREAKER_THRESHOLD, "How many consecutive failures of a script open its circuit breaker, 0 to disable the breakers")
+	breakerCooldown := flag.Duration("breakercooldown", DEFAULT_BREAKER_COOLDOWN, "How long an open circuit breaker rejects messages before trying the script again")
+	webhookSecret := flag.String("webhooksecret", "", "Secret used to sign the body of the webhooks with HMAC-SHA256, empty to not sign them")
+	webhookMaxDeliver := flag.Int("webhookmaxdeliver", DEFAULT_WEBHOOK_MAX_DELIVER, "How many times a webhook is tried before being dropped")
+	capabilities := flag.String("capabilities", executor.LUA_CAPABILITY_ALL, "Comma separated list of the libraries and modules the Lua scripts are allowed to use")
+	maxCallStack := flag.Int("maxcallstack", 0, "Maximum size of the call stack of the Lua scripts, 0 for the default size")
+	maxInstructions := flag.Int64("maxinstructions", 0, "Maximum number of instructions a Lua script runs per message, 0 for no limit")
+	maxMemory := flag.String("maxmemory", "0", "Maximum memory a Lua script can use, estimated from its values (ex: 64m), 0 for no limit")
+	maxRegistry := flag.Int("maxregistry", 0, "Maximum size of the registry of the Lua scripts, 0 for the default size")
+	dataDir := flag.String("datadir", filepath.Join(os.TempDir(), "msgscript-data"), "Directory holding the persistent working directories of the Lua scripts")
+	jetstreamDir := flag.String("jetstreamdir", filepath.Join(os.TempDir(), "msgscript-jetstream"), "Storage directory of the embeded NATS server's JetStream")
 	flag.Parse()
 
 	notifyContext, stop := signal.NotifyContext(context.Background(), syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
@@ -54,6 +66,21 @@ func main() {
 	}
 	log.SetLevel(level)
 
+	if *delivery != script.DELIVERY_BROADCAST && *delivery != script.DELIVERY_QUEUE {
+		log.Fatalf("Invalid delivery mode: %s", *delivery)
+	}
+
+	memoryLimit, err := script.ParseSize(*maxMemory)
+	if err != nil {
+		log.Fatalf("Invalid maximum memory: %v", err)
+	}
+	limits := script.Limits{
+		CallStack:    *maxCallStack,
+		Instructions: *maxInstructions,
+		Memory:       memoryLimit,
+		Registry:     *maxRegistry,
+	}
+
 	if os.Getenv("DEBUG") != "" {
 		log.SetLevel(log.DebugLevel)
 	}
@@ -86,8 +113,10 @@ func main() {
 			// nats isn't provided, we can start an embeded one
 			log.Info("Starting embeded NATS server... on 127.0.0.1:4222")
 			ns, err := natsserver.NewServer(&natsserver.Options{
-				Host: "127.0.0.1",
-				Port: 4222,
+				Host:      "127.0.0.1",
+				Port:      4222,
+				JetStream: true,
+				StoreDir:  *jetstreamDir,
 			})
 			if err != nil {
 				log.Fatalf("failed to start embeded NATS server: %v", err)
@@ -126,175 +155,51 @@ func main() {
 	ctx, cancel := context.WithCancel(notifyContext)
 	defer cancel()
 
-	executors := executor.StartAllExecutors(ctx, scriptStore, plugins, nc)
+	executors := executor.StartAllExecutors(ctx, scriptStore, plugins, nc, executor.LuaOptions{
+		DataDir:      *dataDir,
+		Capabilities: script.SplitList(*capabilities),
+		Limits:       limits,
+	})
 
 	log.Info("Starting message watch...")
 
-	// Set up a message handler
-	_, err = nc.Subscribe(">", func(msg *nats.Msg) {
-		// Extract trace context from NATS message headers
-		ctx := otel.GetTextMapPropagator().Extract(
-			context.Background(),
-			natsHeaderCarrier(msg.Header),
-		)
-
-		// Start a span for the NATS message handling
-		ctx, span := mainTracer.Start(ctx, "nats.handle_message",
-			trace.WithSpanKind(trace.SpanKindServer),
-			trace.WithAttributes(
-				attribute.String("nats.subject", msg.Subject),
-				attribute.Int("nats.message_size", len(msg.Data)),
-			),
-		)
-		defer span.End()
-
-		log.Debugf("Received message on subject: %s", msg.Subject)
-
-		if strings.HasPrefix(msg.Subject, "_INBOX.") {
-			span.SetAttributes(attribute.Bool("nats.is_inbox", true))
-			span.SetStatus(codes.Ok, "Ignored inbox subject")
-			log.Debugf("Ignoring reply subject %s", msg.Subject)
-			return
-		}
-
-		// Check for some special subjects we use internally
-		switch msg.Subject {
-		case subjectListScripts:
-			replyWithSubjectList(ctx, nc, scriptStore, msg.Reply)
-			return
-		case subjectListNamesForScript:
-			replyWithNamesForSubject(ctx, nc, scriptStore, string(msg.Data), msg.Reply)
-			return
-		case subjectInfoNamedSCript:
-			ss := strings.Split(string(msg.Data), ",")
-			if len(ss) != 2 {
-				replyWithError(nc, fmt.Errorf("invalid request"), msg.Reply)
-			}
-			replyWithNamedScriptInfo(ctx, nc, scriptStore, ss[0], ss[1], msg.Reply)
-			return
-		default:
-		}
-
-		m := new(executor.Message)
-		err := json.Unmarshal(msg.Data, m)
-		// if the payload isn't a JSON Message, take it as a whole
-		if err != nil {
-			m.Subject = msg.Subject
-			m.Payload = msg.Data
-			m.Raw = true
-		}
-
-		fields := log.Fields{
-			"subject": m.Subject,
-			"raw":     m.Raw,
-			"async":   m.Async,
-		}
-
-		span.SetAttributes(
-			attribute.Bool("message.raw", m.Raw),
-			attribute.Bool("message.async", m.Async),
-		)
-
-		// The above unmarshalling only applies to the structure of the JSON.
-		// Even if you feed it another JSON where none of the keys matches,
-		// it will just end up being an empty struct
-		if m.Payload == nil {
-			m = &executor.Message{
-				Subject: msg.Subject,
-				Payload: msg.Data,
-			}
-		}
-
-		if m.Async {
-			span.SetAttributes(attribute.String("reply.mode", "async"))
-			err = nc.Publish(msg.Reply, []byte("{}"))
-			if err != nil {
-				span.RecordError(err)
-				span.SetStatus(codes.Error, "Failed to publish async reply")
-				log.WithFields(fields).Errorf("failed to reply to message: %v", err)
-
-				replyWithError(nc, fmt.Errorf("failed to reply to message: %v", err), msg.Reply)
-				return
-			}
-		} else {
-			span.SetAttributes(attribute.String("reply.mode", "sync"))
-		}
-
-		cctx, getScriptsSpan := mainTracer.Start(ctx, "nats.handle_message.get_scripts", trace.WithAttributes(
-			attribute.String("script.Name", m.Subject),
-			attribute.String("script.URL", m.URL),
-		))
+	// Scripts bound to a stream are consumed through JetStream
+	js, err := jetstream.New(nc)
+	if err != nil {
+		log.Fatalf("Failed to create JetStream context: %v", err)
+	}
 
-		scripts, err := scriptStore.GetScripts(cctx, m.Subject)
+	if *deadLetterPrefix != "" {
+		err = ensureDeadLetterStream(ctx, js, *deadLetterPrefix)
 		if err != nil {
-			log.WithError(err).WithField("subject", m.Subject).Error("failed to get scripts for subject")
-			span.RecordError(err)
-			span.SetStatus(codes.Error, "Failed to get scripts")
-
-			replyWithError(nc, fmt.Errorf("failed to get scripts for subject: %v", err), msg.Reply)
-			return
-		}
-		getScriptsSpan.SetStatus(codes.Ok, fmt.Sprintf("found %d scripts", len(scripts)))
-		getScriptsSpan.End()
-
-		_, executeScriptsSpan := mainTracer.Start(ctx, "nats.handle_message.run_scripts")
-		defer executeScriptsSpan.End()
-
-		var wg sync.WaitGroup
-		allResults := make(chan *executor.ScriptResult, len(scripts))
-		for _, scr := range scripts {
-			wg.Add(1)
-
-			go func(ctx context.Context, msg *executor.Message, script *script.Script) {
-				defer wg.Done()
-
-				// Pass the context with trace info to the executor
-				exec, err := executor.ExecutorByName(scr.Executor, executors)
-				if err != nil {
-					executeScriptsSpan.RecordError(err)
-					executeScriptsSpan.SetStatus(codes.Error, "Failed to get executor")
-					log.WithError(err).Error("failed to get executor for script")
-
-					allResults <- &executor.ScriptResult{Error: fmt.Sprintf("failed to get executor for script: %v", err)}
-					return
-				}
-
-				allResults <- exec.HandleMessage(ctx, m, scr)
-			}(ctx, m, scr)
+			log.Warnf("Dead letters will not be kept: %v", err)
 		}
-		wg.Wait()
-
-		close(allResults)
-
-		_, parseReplySpan := mainTracer.Start(ctx, "nats.handle_message.parse_replies")
-		msgRep := new(Reply)
-		for res := range allResults {
-			if res.IsHTML {
-				msgRep.HTML = true
-			}
+	}
 
-			msgRep.Results = append(msgRep.Results, res)
-		}
-		parseReplySpan.SetAttributes(attribute.Int("responses", len(msgRep.Results)))
-		parseReplySpan.SetStatus(codes.Ok, "responses parsed")
-		parseReplySpan.End()
+	// The results of the scripts with an endpoint are delivered from a stream
+	webhooks, err := newWebhookDispatcher(ctx, js, *webhookSecret, *webhookMaxDeliver)
+	if err != nil {
+		log.Warnf("Webhooks will not be delivered: %v", err)
+	} else {
+		defer webhooks.Stop()
+	}
 
-		_, natsReplaySpan := mainTracer.Start(ctx, "nats.handle_message.send_reply")
-		err = replyMessage(nc, m, msg.Reply, msgRep)
-		if err != nil {
-			natsReplaySpan.RecordError(err)
-			natsReplaySpan.SetStatus(codes.Error, "Failed to send reply through NATS")
+	// Only subscribe to the subjects that have scripts registered to them
+	handler := newMessageHandler(nc, js, scriptStore, executors, *delivery, *deadLetterPrefix, *jobTTL, newConcurrencyLimiter(*maxConcurrency, *waitQueueSize), newCircuitBreakers(*breakerThreshold, *breakerCooldown), webhooks)
+	schedules := newScheduleManager(scriptStore, handler)
 
-			log.WithError(err).Errorf("failed to send reply through NATS")
-			return
-		}
+	// Internal subjects are used by the HTTP handler and the CLI
+	err = subscribeInternalSubjects(nc, scriptStore, schedules, handler.cache, handler.breakers)
+	if err != nil {
+		log.Fatalf("Failed to subscribe to internal subjects: %v", err)
+	}
 
-		log.WithField("subject", msg.Subject).Debugf("finished running %d scripts", len(scripts))
-		span.SetStatus(codes.Ok, "Message handled")
-	})
+	subscriptions := newSubscriptionManager(nc, scriptStore, handler, *queueGroup, newStreamManager(js, handler), schedules)
+	err = subscriptions.Start(ctx)
 	if err != nil {
 		log.Fatalf("Failed to subscribe to NATS subjects: %v", err)
 	}
+	defer subscriptions.Stop()
 
 	defer func() {
 		log.Info("Received shutdown signal, stopping server...")
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nats-io/nats.go"
 
@@ -17,8 +19,45 @@ const (
 	subjectListScripts        = "__listScripts"
 	subjectListNamesForScript = "__listNamesForScript"
 	subjectInfoNamedSCript    = "__infoNamedScript"
+	subjectJobStatus          = "__jobStatus"
+	subjectCachePurge         = "__cachePurge"
 )
 
+// subscribeInternalSubjects subscribes to the special subjects used to query the server
+func subscribeInternalSubjects(nc *nats.Conn, scriptStore store.ScriptStore, schedules *scheduleManager, cache *resultCache, breakers *circuitBreakers) error {
+	handlers := map[string]nats.MsgHandler{
+		subjectListScripts: func(msg *nats.Msg) {
+			replyWithSubjectList(context.Background(), nc, scriptStore, msg.Reply)
+		},
+		subjectListNamesForScript: func(msg *nats.Msg) {
+			replyWithNamesForSubject(context.Background(), nc, scriptStore, string(msg.Data), msg.Reply)
+		},
+		subjectInfoNamedSCript: func(msg *nats.Msg) {
+			ss := strings.Split(string(msg.Data), ",")
+			if len(ss) != 2 {
+				replyWithError(nc, fmt.Errorf("invalid request"), msg.Reply)
+				return
+			}
+			replyWithNamedScriptInfo(context.Background(), nc, scriptStore, schedules, breakers, ss[0], ss[1], msg.Reply)
+		},
+		subjectJobStatus: func(msg *nats.Msg) {
+			replyWithJobStatus(context.Background(), nc, scriptStore, string(msg.Data), msg.Reply)
+		},
+		subjectCachePurge: func(msg *nats.Msg) {
+			replyWithCachePurge(context.Background(), nc, cache, string(msg.Data), msg.Reply)
+		},
+	}
+
+	for subject, handler := range handlers {
+		_, err := nc.Subscribe(subject, handler)
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+		}
+	}
+
+	return nil
+}
+
 func replyWithSubjectList(ctx context.Context, nc *nats.Conn, scriptStore store.ScriptStore, replySubject string) {
 	subjects, err := scriptStore.ListSubjects(ctx)
 	if err != nil {
@@ -85,7 +124,7 @@ func replyWithNamesForSubject(ctx context.Context, nc *nats.Conn, scriptStore st
 	})
 }
 
-func replyWithNamedScriptInfo(ctx context.Context, nc *nats.Conn, scriptStore store.ScriptStore, subject, name, replySubject string) {
+func replyWithNamedScriptInfo(ctx context.Context, nc *nats.Conn, scriptStore store.ScriptStore, schedules *scheduleManager, breakers *circuitBreakers, subject, name, replySubject string) {
 	allScripts, err := scriptStore.GetScripts(ctx, subject)
 	if err != nil {
 		replyWithError(nc, err, replySubject)
@@ -110,15 +149,41 @@ func replyWithNamedScriptInfo(ctx context.Context, nc *nats.Conn, scriptStore st
 		script.Executor = executor.EXECUTOR_LUA_NAME
 	}
 
+	headers := map[string]string{
+		"libraries": strings.Join(script.LibKeys, ", "),
+		"executor":  script.Executor,
+	}
+
+	// The runs are only known by the scheduler
+	if spec, lastRun, lastError, upcoming, found := schedules.Info(subject, name); found {
+		var runs []string
+		for _, t := range upcoming {
+			runs = append(runs, t.Format(time.RFC3339))
+		}
+
+		headers["schedule"] = spec
+		headers["next_runs"] = strings.Join(runs, ", ")
+		if !lastRun.IsZero() {
+			headers["last_run"] = lastRun.Format(time.RFC3339)
+			headers["last_error"] = lastError
+		}
+	}
+
+	// Each instance has its own breakers, this is the state of the one replying
+	if state, failures, openedAt := breakers.info(script.Subject, script.Name); state != "" {
+		headers["breaker_state"] = state
+		headers["breaker_failures"] = strconv.Itoa(failures)
+		if !openedAt.IsZero() {
+			headers["breaker_opened_at"] = openedAt.Format(time.RFC3339)
+		}
+	}
+
 	replyMessage(nc, &executor.Message{}, replySubject, &Reply{
 		Results: []*executor.ScriptResult{
 			{
-				Code:  http.StatusOK,
-				Error: "",
-				Headers: map[string]string{
-					"libraries": strings.Join(script.LibKeys, ", "),
-					"executor":  script.Executor,
-				},
+				Code:    http.StatusOK,
+				Error:   "",
+				Headers: headers,
 				IsHTML:  script.HTML,
 				Payload: script.Content,
 			},
@@ -127,3 +192,27 @@ func replyWithNamedScriptInfo(ctx context.Context, nc *nats.Conn, scriptStore st
 		Error: "",
 	})
 }
+
+// replyWithCachePurge removes the cached results of the subject (or pattern). Every instance receives the message
+// to purge its own cache.
+func replyWithCachePurge(ctx context.Context, nc *nats.Conn, cache *resultCache, subject, replySubject string) {
+	if subject == "" {
+		replyWithError(nc, fmt.Errorf("subject is required"), replySubject)
+		return
+	}
+
+	err := cache.purge(ctx, subject)
+	if err != nil {
+		replyWithError(nc, err, replySubject)
+		return
+	}
+
+	replyMessage(nc, &executor.Message{}, replySubject, &Reply{
+		Results: []*executor.ScriptResult{
+			{
+				Code:    http.StatusOK,
+				Payload: []byte(fmt.Sprintf("cache of %s purged", subject)),
+			},
+		},
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+const (
+	PIPELINE_DEPTH_HEADER = "Msgscript-Pipeline-Depth"
+	// Protects against pipelines looping back on themselves
+	MAX_PIPELINE_DEPTH = 16
+	// How long to wait for the next step of a pipeline when the message doesn't have a deadline
+	PIPELINE_STEP_TIMEOUT = executor.MAX_LUA_RUNNING_TIME
+)
+
+type pipelineDepthKey struct{}
+
+// withPipelineDepth stores in the context how many steps of a pipeline ran before the message was received
+func withPipelineDepth(ctx context.Context, header nats.Header) context.Context {
+	depth, err := strconv.Atoi(header.Get(PIPELINE_DEPTH_HEADER))
+	if err != nil {
+		depth = 0
+	}
+
+	return context.WithValue(ctx, pipelineDepthKey{}, depth)
+}
+
+func pipelineDepth(ctx context.Context) int {
+	depth, _ := ctx.Value(pipelineDepthKey{}).(int)
+	return depth
+}
+
+// runPipeline runs the script and, when it succeeds and has a next subject, forwards its result to it.
+// The results of the last step of the pipeline are returned. A duplicate message isn't run nor forwarded again.
+func (h *messageHandler) runPipeline(ctx context.Context, m *executor.Message, scr *script.Script) []*executor.ScriptResult {
+	return h.runDeduplicated(ctx, m, scr, func() []*executor.ScriptResult {
+		res := h.runScript(ctx, m, scr)
+		if scr.Next == "" || res.Error != "" {
+			return []*executor.ScriptResult{res}
+		}
+
+		return h.forward(ctx, m, scr, res)
+	})
+}
+
+// forward sends the payload of the result as a new message on the script's next subject and waits for its reply
+func (h *messageHandler) forward(ctx context.Context, m *executor.Message, scr *script.Script, res *executor.ScriptResult) []*executor.ScriptResult {
+	depth := pipelineDepth(ctx) + 1
+
+	ctx, span := mainTracer.Start(ctx, "pipeline.forward",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("script.name", scr.Name),
+			attribute.String("pipeline.next", scr.Next),
+			attribute.Int("pipeline.depth", depth),
+		),
+	)
+	defer span.End()
+
+	fields := log.Fields{
+		"subject": m.Subject,
+		"name":    scr.Name,
+		"next":    scr.Next,
+	}
+
+	withError := func(err error) []*executor.ScriptResult {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		log.WithFields(fields).Error(err)
+
+		return []*executor.ScriptResult{executor.ScriptResultWithError(err)}
+	}
+
+	if depth > MAX_PIPELINE_DEPTH {
+		return withError(fmt.Errorf("pipeline is deeper than %d steps, stopping at %s", MAX_PIPELINE_DEPTH, scr.Next))
+	}
+
+	body, err := json.Marshal(&executor.Message{
+		Aggregate: m.Aggregate,
+		Headers:   m.Headers,
+		Method:    m.Method,
+		Payload:   res.Payload,
+		Subject:   scr.Next,
+		URL:       m.URL,
+	})
+	if err != nil {
+		return withError(fmt.Errorf("failed to encode message for %s: %w", scr.Next, err))
+	}
+
+	msg := nats.NewMsg(scr.Next)
+	msg.Data = body
+	msg.Header.Set(PIPELINE_DEPTH_HEADER, strconv.Itoa(depth))
+	otel.GetTextMapPropagator().Inject(ctx, natsHeaderCarrier(msg.Header))
+
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, PIPELINE_STEP_TIMEOUT)
+		defer cancel()
+	}
+	setDeadlineHeader(ctx, msg.Header)
+
+	log.WithFields(fields).Debug("forwarding result to the next step of the pipeline")
+	response, err := h.nc.RequestMsgWithContext(ctx, msg)
+	if errors.Is(err, nats.ErrNoResponders) {
+		return withError(fmt.Errorf("no script found for the next subject %s", scr.Next))
+	}
+	if err != nil {
+		return withError(fmt.Errorf("failed to send message to %s: %w", scr.Next, err))
+	}
+
+	rep := new(Reply)
+	err = json.Unmarshal(response.Data, rep)
+	if err != nil {
+		return withError(fmt.Errorf("failed to decode reply from %s: %w", scr.Next, err))
+	}
+
+	if rep.Error != "" {
+		return withError(fmt.Errorf("next step %s failed: %s", scr.Next, rep.Error))
+	}
+
+	span.SetAttributes(attribute.Int("pipeline.results", len(rep.Results)))
+	span.SetStatus(codes.Ok, "Forwarded to next step")
+
+	return rep.Results
+}
+
+// pipelineError returns the first error of the results
+func pipelineError(results []*executor.ScriptResult) string {
+	for _, res := range results {
+		if res.Error != "" {
+			return res.Error
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+// stepExecutor appends the name of the script to the payload
+type stepExecutor struct{}
+
+func (stepExecutor) HandleMessage(ctx context.Context, msg *executor.Message, scr *script.Script) *executor.ScriptResult {
+	return &executor.ScriptResult{Payload: append(msg.Payload, []byte("|"+scr.Name)...)}
+}
+
+func (stepExecutor) HandleBatch(ctx context.Context, msgs []*executor.Message, scr *script.Script) []*executor.ScriptResult {
+	return nil
+}
+
+func (stepExecutor) Stop() {}
+
+func TestPipeline(t *testing.T) {
+	ctx := context.Background()
+	nc, js := startTestNats(t)
+	h, store := newTestHandler(t, nc, js, stepExecutor{}, "")
+
+	store.AddScript(ctx, "orders.validate", "validate", &script.Script{Subject: "orders.validate", Name: "validate", Delivery: script.DELIVERY_QUEUE, Next: "orders.enrich"})
+	store.AddScript(ctx, "orders.enrich", "enrich", &script.Script{Subject: "orders.enrich", Name: "enrich", Delivery: script.DELIVERY_QUEUE, Next: "orders.store"})
+	store.AddScript(ctx, "orders.store", "store", &script.Script{Subject: "orders.store", Name: "store", Delivery: script.DELIVERY_QUEUE})
+
+	sm := newSubscriptionManager(nc, store, h, DEFAULT_QUEUE_GROUP, nil, nil)
+	for _, subject := range []string{"orders.validate", "orders.enrich", "orders.store"} {
+		sm.refresh(ctx, subject)
+	}
+	defer sm.Stop()
+
+	// Each step receives the payload of the previous one, the requester gets the reply of the last one
+	resp, err := nc.Request("orders.validate", []byte("order"), 5*time.Second)
+	assert.Nil(t, err)
+
+	rep := new(Reply)
+	assert.Nil(t, json.Unmarshal(resp.Data, rep))
+	assert.Equal(t, "", rep.Error)
+	if assert.Len(t, rep.Results, 1) {
+		assert.Equal(t, "store", rep.Results[0].Name)
+		assert.Equal(t, "order|validate|enrich|store", string(rep.Results[0].Payload))
+	}
+
+	// A step without any script stops the pipeline with an error
+	store.DeleteScript(ctx, "orders.store", "store")
+	sm.refresh(ctx, "orders.store")
+
+	resp, err = nc.Request("orders.validate", []byte("order"), 5*time.Second)
+	assert.Nil(t, err)
+	rep = new(Reply)
+	assert.Nil(t, json.Unmarshal(resp.Data, rep))
+	if assert.Len(t, rep.Results, 1) {
+		assert.Contains(t, rep.Results[0].Error, "orders.store")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+const (
+	RATE_LIMIT_KEY_PREFIX = "ratelimit"
+	RETRY_AFTER_HEADER    = "Retry-After"
+)
+
+// rateBucket is the state of a token bucket, shared between the instances through the store
+type rateBucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// take refills the bucket for the time elapsed since it was last updated and takes a token out of it.
+// When the bucket is empty, it returns how long to wait for the next token.
+func (b *rateBucket) take(rl script.RateLimit, now time.Time) time.Duration {
+	perToken := rl.Per / time.Duration(rl.Rate)
+
+	if b.Updated.IsZero() {
+		b.Tokens = float64(rl.Burst)
+	} else if elapsed := now.Sub(b.Updated); elapsed > 0 {
+		b.Tokens = math.Min(float64(rl.Burst), b.Tokens+float64(elapsed)/float64(perToken))
+	}
+	b.Updated = now
+
+	if b.Tokens < 1 {
+		return time.Duration((1 - b.Tokens) * float64(perToken))
+	}
+
+	b.Tokens--
+	return 0
+}
+
+// takeRateToken checks if the script is allowed to run under its rate limit. It returns how long to wait
+// before retrying when it isn't.
+func (h *messageHandler) takeRateToken(ctx context.Context, scr *script.Script) time.Duration {
+	rl := scr.RateLimit
+	key := strings.Join([]string{RATE_LIMIT_KEY_PREFIX, scr.Subject, scr.Name}, "/")
+
+	// The bucket is full again once it expires
+	ttl := rl.Per * time.Duration(rl.Burst) / time.Duration(rl.Rate)
+
+	var wait time.Duration
+	err := h.store.UpdateValue(ctx, key, ttl+time.Second, func(value []byte) ([]byte, error) {
+		b := new(rateBucket)
+		if value != nil {
+			err := json.Unmarshal(value, b)
+			if err != nil {
+				// Start over with a full bucket
+				b = new(rateBucket)
+			}
+		}
+
+		wait = b.take(rl, time.Now())
+		return json.Marshal(b)
+	})
+	if err != nil {
+		// Not being able to keep track of the rate shouldn't stop the scripts from running
+		log.WithField("subject", scr.Subject).WithField("name", scr.Name).Warnf("failed to check rate limit: %v", err)
+		return 0
+	}
+
+	return wait
+}
+
+// rateLimitedResult returns the result of a script that wasn't run because of its rate limit
+func rateLimitedResult(scr *script.Script, wait time.Duration) *executor.ScriptResult {
+	return &executor.ScriptResult{
+		Name:  scr.Name,
+		Error: (&executor.RateLimitedError{}).Error(),
+		Headers: map[string]string{
+			RETRY_AFTER_HEADER: strconv.Itoa(int(math.Ceil(wait.Seconds()))),
+		},
+	}
+}
+
+// rateLimited tells if all the scripts were rejected by their rate limit, along with the longest delay
+// before retrying in seconds
+func rateLimited(results []*executor.ScriptResult) (string, bool) {
+	if len(results) == 0 {
+		return "", false
+	}
+
+	var retryAfter int
+	for _, res := range results {
+		if res.Error != (&executor.RateLimitedError{}).Error() {
+			return "", false
+		}
+
+		seconds, err := strconv.Atoi(res.Headers[RETRY_AFTER_HEADER])
+		if err == nil && seconds > retryAfter {
+			retryAfter = seconds
+		}
+	}
+
+	return strconv.Itoa(retryAfter), true
+}
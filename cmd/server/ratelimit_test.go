@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/numkem/msgscript/script"
+)
+
+func TestRateBucketTake(t *testing.T) {
+	rl := script.RateLimit{Rate: 10, Per: time.Second, Burst: 2}
+	now := time.Now()
+	b := new(rateBucket)
+
+	// The burst is allowed right away
+	assert.Zero(t, b.take(rl, now))
+	assert.Zero(t, b.take(rl, now))
+	assert.Equal(t, 100*time.Millisecond, b.take(rl, now))
+
+	// A token is added every 100ms
+	assert.Equal(t, 50*time.Millisecond, b.take(rl, now.Add(50*time.Millisecond)))
+	assert.Zero(t, b.take(rl, now.Add(100*time.Millisecond)))
+
+	// The bucket never holds more than the burst
+	later := now.Add(time.Minute)
+	assert.Zero(t, b.take(rl, later))
+	assert.Zero(t, b.take(rl, later))
+	assert.NotZero(t, b.take(rl, later))
+}
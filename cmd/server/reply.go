@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/nats-io/nats.go"
 	log "github.com/sirupsen/logrus"
@@ -14,6 +16,7 @@ type Reply struct {
 	Results []*executor.ScriptResult `json:"script_result"`
 	HTML    bool                     `json:"is_html"`
 	Error   string                   `json:"error,omitempty"`
+	JobID   string                   `json:"job_id,omitempty"`
 }
 
 func replyMessage(nc *nats.Conn, msg *executor.Message, replySubject string, rep *Reply) error {
@@ -36,8 +39,12 @@ func replyMessage(nc *nats.Conn, msg *executor.Message, replySubject string, rep
 		return fmt.Errorf("failed to serialize script reply to JSON: %v", err)
 	}
 
+	reply := nats.NewMsg(replySubject)
+	reply.Data = payload
+	reply.Header = replyHeaders(rep.Results)
+
 	log.WithFields(fields).Debugf("sent reply: %s", string(payload))
-	err = nc.Publish(replySubject, payload)
+	err = nc.PublishMsg(reply)
 	if err != nil {
 		log.WithFields(fields).Errorf("failed to publish reply after running script: %v", err)
 	}
@@ -45,6 +52,35 @@ func replyMessage(nc *nats.Conn, msg *executor.Message, replySubject string, rep
 	return nil
 }
 
+// The prefixes of the headers the scripts can't set on the reply, they are used by NATS and the server
+var reservedHeaderPrefixes = []string{"Nats-", "Msgscript-"}
+
+// replyHeaders returns the headers returned by the scripts to set on the NATS reply. The results are merged in the
+// order of the script names, the last one by name wins when several scripts return the same header whatever order
+// they finished in. The reserved headers along with the `Status` and `Description` ones used by NATS for the status
+// of the reply are dropped.
+func replyHeaders(results []*executor.ScriptResult) nats.Header {
+	sorted := slices.Clone(results)
+	slices.SortStableFunc(sorted, func(a, b *executor.ScriptResult) int { return strings.Compare(a.Name, b.Name) })
+
+	header := make(nats.Header)
+	for _, res := range sorted {
+		for k, v := range res.Headers {
+			reserved := slices.ContainsFunc(reservedHeaderPrefixes, func(prefix string) bool {
+				return len(k) >= len(prefix) && strings.EqualFold(k[:len(prefix)], prefix)
+			})
+			if reserved || strings.EqualFold(k, "Status") || strings.EqualFold(k, "Description") {
+				log.WithField("name", res.Name).Debugf("script can't set the %s header on the reply", k)
+				continue
+			}
+
+			header.Set(k, v)
+		}
+	}
+
+	return header
+}
+
 func replyWithError(nc *nats.Conn, resErr error, replySubject string) {
 	payload, err := json.Marshal(&Reply{Error: resErr.Error()})
 	if err != nil {
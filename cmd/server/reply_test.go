@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/numkem/msgscript/executor"
+)
+
+func TestReplyHeaders(t *testing.T) {
+	// The scripts finished in any order, the last one by name wins
+	header := replyHeaders([]*executor.ScriptResult{
+		{Name: "c", Headers: map[string]string{"X-Shared": "c"}},
+		{Name: "a", Headers: map[string]string{"X-Shared": "a", "X-Tenant-Id": "acme", "Nats-Msg-Id": "1", "Status": "503"}},
+		{Name: "b", Headers: map[string]string{"X-Shared": "b", "msgscript-deadline": "now", "Retry-After": "5"}},
+	})
+
+	assert.Equal(t, nats.Header{
+		"X-Shared":    []string{"c"},
+		"X-Tenant-Id": []string{"acme"},
+		"Retry-After": []string{"5"},
+	}, header)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/schedule"
+	"github.com/numkem/msgscript/script"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+const (
+	SCHEDULE_UPCOMING_RUNS = 5
+	// How long after its tick the lock of a run is kept at least, the instances with a clock running late fire the
+	// same tick a bit later and must find it taken
+	SCHEDULE_LOCK_HOLD = 5 * time.Second
+)
+
+type scheduledScript struct {
+	mu        sync.Mutex
+	spec      string
+	schedule  schedule.Schedule
+	cancel    context.CancelFunc
+	lastRun   time.Time
+	lastError string
+}
+
+// scheduleManager runs the scripts that have a schedule on their cadence
+type scheduleManager struct {
+	mu      sync.Mutex
+	store   msgstore.ScriptStore
+	handler *messageHandler
+	entries map[string]*scheduledScript
+}
+
+func newScheduleManager(store msgstore.ScriptStore, handler *messageHandler) *scheduleManager {
+	return &scheduleManager{
+		store:   store,
+		handler: handler,
+		entries: make(map[string]*scheduledScript),
+	}
+}
+
+func scheduleKey(subject, name string) string {
+	return strings.Join([]string{subject, name}, "/")
+}
+
+// refresh starts, restarts or stops the schedules of the subject so they match the scripts
+func (sm *scheduleManager) refresh(ctx context.Context, subject string, scripts map[string]*script.Script) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	wanted := make(map[string]*script.Script)
+	for name, scr := range scripts {
+		if scr.Schedule != "" {
+			wanted[scheduleKey(subject, name)] = scr
+		}
+	}
+
+	for key, entry := range sm.entries {
+		if !strings.HasPrefix(key, subject+"/") {
+			continue
+		}
+
+		scr, found := wanted[key]
+		if found && entry.spec == scr.Schedule {
+			continue
+		}
+
+		entry.cancel()
+		delete(sm.entries, key)
+		log.WithField("subject", subject).WithField("key", key).Info("stopped schedule")
+	}
+
+	for key, scr := range wanted {
+		if _, found := sm.entries[key]; found {
+			continue
+		}
+
+		fields := log.Fields{
+			"subject":  subject,
+			"name":     scr.Name,
+			"schedule": scr.Schedule,
+		}
+
+		sched, err := schedule.Parse(scr.Schedule)
+		if err != nil {
+			log.WithFields(fields).Errorf("invalid schedule, script will not be scheduled: %v", err)
+			continue
+		}
+
+		sctx, cancel := context.WithCancel(ctx)
+		entry := &scheduledScript{
+			spec:     scr.Schedule,
+			schedule: sched,
+			cancel:   cancel,
+		}
+		sm.entries[key] = entry
+
+		go sm.run(sctx, subject, strings.TrimPrefix(key, subject+"/"), entry)
+		log.WithFields(fields).Info("started schedule")
+	}
+}
+
+func (sm *scheduleManager) run(ctx context.Context, subject, name string, entry *scheduledScript) {
+	for {
+		next := entry.schedule.Next(time.Now())
+		if next.IsZero() {
+			log.WithField("subject", subject).WithField("name", name).Warn("schedule never runs")
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		sm.fire(ctx, subject, name, entry, next)
+	}
+}
+
+// fire runs the script for the given tick. Every instance of the server fires the same ticks
+// so the lock is taken on the tick to only have one of them run the script.
+func (sm *scheduleManager) fire(ctx context.Context, subject, name string, entry *scheduledScript, tick time.Time) {
+	ctx, span := mainTracer.Start(ctx, "schedule.run",
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(
+			attribute.String("script.subject", subject),
+			attribute.String("script.name", name),
+			attribute.String("schedule.tick", tick.Format(time.RFC3339)),
+		),
+	)
+	defer span.End()
+
+	fields := log.Fields{
+		"subject": subject,
+		"name":    name,
+	}
+
+	scripts, err := sm.store.GetScripts(ctx, subject)
+	scr, found := scripts[name]
+	if err != nil || !found {
+		span.SetStatus(codes.Error, "Script not found")
+		log.WithFields(fields).Error("failed to find scheduled script")
+		return
+	}
+
+	lockKey := fmt.Sprintf("%s_schedule_%d", scheduleKey(subject, name), tick.Unix())
+	locked, err := sm.store.TakeLock(ctx, lockKey)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to acquire lock")
+		log.WithFields(fields).Errorf("failed to get lock for scheduled run: %v", err)
+		return
+	}
+	if !locked {
+		span.SetStatus(codes.Ok, "Run by another instance")
+		log.WithFields(fields).Debug("scheduled run taken by another instance")
+		return
+	}
+	defer func() {
+		time.AfterFunc(time.Until(tick.Add(SCHEDULE_LOCK_HOLD)), func() {
+			err := sm.store.ReleaseLock(context.Background(), lockKey)
+			if err != nil {
+				log.WithFields(fields).Errorf("failed to release the lock of the scheduled run: %v", err)
+			}
+		})
+	}()
+
+	// Only the instance running the tick keeps track of it
+	entry.mu.Lock()
+	entry.lastRun = tick
+	entry.lastError = ""
+	entry.mu.Unlock()
+
+	s := *scr
+	s.Delivery = script.DELIVERY_SCHEDULE
+
+	msgSubject := subject
+	if s.Subject != "" {
+		msgSubject = s.Subject
+	}
+
+	resErr := pipelineError(sm.handler.runPipeline(ctx, &executor.Message{
+		Subject:   msgSubject,
+		Payload:   []byte(tick.Format(time.RFC3339)),
+		Raw:       true,
+		Scheduled: true,
+	}, &s))
+
+	entry.mu.Lock()
+	entry.lastError = resErr
+	entry.mu.Unlock()
+
+	if resErr != "" {
+		span.SetStatus(codes.Error, resErr)
+		log.WithFields(fields).Errorf("scheduled run failed: %s", resErr)
+		return
+	}
+
+	log.WithFields(fields).Debug("scheduled run finished")
+	span.SetStatus(codes.Ok, "Scheduled run finished")
+}
+
+// Info returns the schedule of the script along with its last and upcoming runs
+func (sm *scheduleManager) Info(subject, name string) (spec string, lastRun time.Time, lastError string, upcoming []time.Time, found bool) {
+	sm.mu.Lock()
+	entry, found := sm.entries[scheduleKey(subject, name)]
+	sm.mu.Unlock()
+	if !found {
+		return "", time.Time{}, "", nil, false
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	next := time.Now()
+	for range SCHEDULE_UPCOMING_RUNS {
+		next = entry.schedule.Next(next)
+		if next.IsZero() {
+			break
+		}
+		upcoming = append(upcoming, next)
+	}
+
+	return entry.spec, entry.lastRun, entry.lastError, upcoming, true
+}
+
+// Stop stops all the schedules
+func (sm *scheduleManager) Stop() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for key, entry := range sm.entries {
+		entry.cancel()
+		delete(sm.entries, key)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+const (
+	DEFAULT_QUEUE_GROUP = "msgscript"
+	// Maximum number of messages handled at once, the next ones are rejected until one is done
+	MAX_PENDING_MESSAGES = 10000
+)
+
+type subscriptionKey struct {
+	subject  string
+	delivery string
+}
+
+// subscriptionManager keeps a single NATS subscription per subject (or pattern) and delivery mode
+// that has scripts registered to it
+type subscriptionManager struct {
+	mu         sync.Mutex
+	nc         *nats.Conn
+	store      msgstore.ScriptStore
+	handler    *messageHandler
+	queueGroup string
+	streams    *streamManager
+	schedules  *scheduleManager
+	subs       map[subscriptionKey]*nats.Subscription
+	pending    chan struct{}
+}
+
+func newSubscriptionManager(nc *nats.Conn, store msgstore.ScriptStore, handler *messageHandler, queueGroup string, streams *streamManager, schedules *scheduleManager) *subscriptionManager {
+	return &subscriptionManager{
+		nc:         nc,
+		store:      store,
+		handler:    handler,
+		queueGroup: queueGroup,
+		streams:    streams,
+		schedules:  schedules,
+		subs:       make(map[subscriptionKey]*nats.Subscription),
+		pending:    make(chan struct{}, MAX_PENDING_MESSAGES),
+	}
+}
+
+// Start subscribes to all the subjects currently in the store and keeps the subscriptions
+// in sync with the store until the context is cancelled
+func (sm *subscriptionManager) Start(ctx context.Context) error {
+	subjects, err := sm.store.ListSubjects(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list subjects: %w", err)
+	}
+
+	for _, subject := range subjects {
+		sm.refresh(ctx, subject)
+	}
+
+	go sm.store.WatchScripts(ctx, "", func(subject, name string, _ []byte, deleted bool) {
+		log.WithField("subject", subject).WithField("name", name).WithField("deleted", deleted).Debug("script changed")
+
+		sm.refresh(ctx, subject)
+	})
+
+	return nil
+}
+
+// refresh subscribes or unsubscribes from the subject for each delivery mode depending if it still has
+// scripts registered to it using that mode
+func (sm *subscriptionManager) refresh(ctx context.Context, subject string) {
+	if subject == "" {
+		return
+	}
+
+	// The subscriptions are kept as they are when the store can't be read, they are refreshed on the next change
+	scripts, err := sm.store.GetScripts(ctx, subject)
+	if err != nil {
+		log.WithField("subject", subject).Errorf("failed to get scripts, keeping the subscriptions: %v", err)
+		return
+	}
+
+	registered := make(map[string]bool)
+	for _, scr := range scripts {
+		delivery := sm.handler.deliveryFor(scr)
+		if delivery == script.DELIVERY_STREAM {
+			continue
+		}
+		if delivery != script.DELIVERY_BROADCAST && delivery != script.DELIVERY_QUEUE {
+			log.WithField("subject", subject).WithField("name", scr.Name).Warnf("unknown delivery mode %s, script will not be run", delivery)
+			continue
+		}
+
+		registered[delivery] = true
+	}
+
+	// Scripts bound to a stream are triggered through their own consumer
+	if sm.streams != nil {
+		sm.streams.refresh(ctx, subject, scripts)
+	}
+
+	if sm.schedules != nil {
+		sm.schedules.refresh(ctx, subject, scripts)
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for _, delivery := range []string{script.DELIVERY_BROADCAST, script.DELIVERY_QUEUE} {
+		fields := log.Fields{
+			"subject":  subject,
+			"delivery": delivery,
+		}
+		key := subscriptionKey{subject: subject, delivery: delivery}
+
+		sub, subscribed := sm.subs[key]
+		switch {
+		case registered[delivery] && !subscribed:
+			sub, err = sm.subscribe(subject, delivery)
+			if err != nil {
+				log.WithFields(fields).Errorf("failed to subscribe: %v", err)
+				continue
+			}
+
+			sm.subs[key] = sub
+			log.WithFields(fields).Info("subscribed to subject")
+
+		case !registered[delivery] && subscribed:
+			err = sub.Unsubscribe()
+			if err != nil {
+				log.WithFields(fields).Errorf("failed to unsubscribe: %v", err)
+			}
+
+			delete(sm.subs, key)
+			log.WithFields(fields).Info("unsubscribed from subject")
+		}
+	}
+}
+
+func (sm *subscriptionManager) subscribe(subject, delivery string) (*nats.Subscription, error) {
+	handler := func(msg *nats.Msg) {
+		sm.dispatch(subject, delivery, msg)
+	}
+
+	// Within a queue group only one of the server instances receives the message
+	if delivery == script.DELIVERY_QUEUE {
+		return sm.nc.QueueSubscribe(subject, sm.queueGroup, handler)
+	}
+
+	return sm.nc.Subscribe(subject, handler)
+}
+
+// patterns returns the subscribed subjects and patterns of the delivery mode matching the subject, sorted
+func (sm *subscriptionManager) patterns(subject, delivery string) []string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	var patterns []string
+	for key := range sm.subs {
+		if key.delivery == delivery && msgstore.SubjectMatches(key.subject, subject) {
+			patterns = append(patterns, key.subject)
+		}
+	}
+	sort.Strings(patterns)
+
+	return patterns
+}
+
+// dispatch hands the message received on the subscription to the handler. A message matching several patterns
+// is received once for each of their subscriptions, only the one of the first pattern handles it with the scripts
+// of all of them so the requester gets a single reply.
+func (sm *subscriptionManager) dispatch(subject, delivery string, msg *nats.Msg) {
+	patterns := sm.patterns(msg.Subject, delivery)
+	if len(patterns) == 0 || patterns[0] != subject {
+		return
+	}
+
+	if sm.handler.isDeadLetter(msg.Subject) {
+		log.WithField("subject", msg.Subject).Debug("ignoring dead letter")
+		return
+	}
+
+	select {
+	case sm.pending <- struct{}{}:
+	default:
+		log.WithField("subject", msg.Subject).Warn("too many messages being handled, message rejected")
+		if msg.Reply != "" {
+			replyWithError(sm.nc, &executor.OverloadedError{}, msg.Reply)
+		}
+		return
+	}
+
+	// Messages are handled concurrently so a pipeline can send a message back on the same subscription
+	// without waiting on itself
+	go func() {
+		defer func() { <-sm.pending }()
+
+		sm.handler.HandleMessage(patterns, delivery, msg)
+	}()
+}
+
+// Stop removes all the subscriptions, stream consumers and schedules
+func (sm *subscriptionManager) Stop() {
+	if sm.streams != nil {
+		sm.streams.Stop()
+	}
+
+	if sm.schedules != nil {
+		sm.schedules.Stop()
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for key, sub := range sm.subs {
+		err := sub.Unsubscribe()
+		if err != nil {
+			log.WithField("subject", key.subject).WithField("delivery", key.delivery).Errorf("failed to unsubscribe: %v", err)
+		}
+	}
+	sm.subs = make(map[subscriptionKey]*nats.Subscription)
+}
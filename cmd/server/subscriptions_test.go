@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/numkem/msgscript/script"
+)
+
+func TestSubscriptionPatterns(t *testing.T) {
+	sm := newSubscriptionManager(nil, nil, nil, DEFAULT_QUEUE_GROUP, nil, nil)
+	for _, key := range []subscriptionKey{
+		{subject: "events.orders.created", delivery: script.DELIVERY_BROADCAST},
+		{subject: "events.>", delivery: script.DELIVERY_BROADCAST},
+		{subject: "events.orders.*", delivery: script.DELIVERY_BROADCAST},
+		{subject: "events.orders.*", delivery: script.DELIVERY_QUEUE},
+		{subject: "audit.>", delivery: script.DELIVERY_BROADCAST},
+	} {
+		sm.subs[key] = new(nats.Subscription)
+	}
+
+	// The first pattern handles the message for all of them
+	assert.Equal(t, []string{"events.>", "events.orders.*", "events.orders.created"}, sm.patterns("events.orders.created", script.DELIVERY_BROADCAST))
+	assert.Equal(t, []string{"events.orders.*"}, sm.patterns("events.orders.created", script.DELIVERY_QUEUE))
+	assert.Empty(t, sm.patterns("other", script.DELIVERY_BROADCAST))
+}
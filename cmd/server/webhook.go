@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/numkem/msgscript/executor"
+	"github.com/numkem/msgscript/script"
+)
+
+const (
+	WEBHOOK_STREAM_NAME   = "MSGSCRIPT_WEBHOOKS"
+	WEBHOOK_SUBJECT       = "msgscript.webhooks"
+	WEBHOOK_CONSUMER_NAME = "msgscript_webhooks"
+	WEBHOOK_TIMEOUT       = 10 * time.Second
+	// How long a result can wait in the stream to be delivered
+	WEBHOOK_MAX_AGE = 24 * time.Hour
+	// How many times a webhook is tried before being dropped
+	DEFAULT_WEBHOOK_MAX_DELIVER = 10
+
+	WEBHOOK_SIGNATURE_HEADER = "X-Msgscript-Signature"
+	WEBHOOK_SUBJECT_HEADER   = "X-Msgscript-Subject"
+	WEBHOOK_NAME_HEADER      = "X-Msgscript-Script"
+)
+
+// webhookDelivery is the result of a script waiting in the stream to be delivered to its endpoint
+type webhookDelivery struct {
+	Name    string                 `json:"name"`
+	Result  *executor.ScriptResult `json:"result"`
+	Subject string                 `json:"subject"`
+	Time    time.Time              `json:"time"`
+	URL     string                 `json:"url"`
+}
+
+// webhookDispatcher keeps the results to deliver in a JetStream stream and POSTs them to the endpoint of their script.
+// All the instances of the server share the same consumer so each result is delivered once.
+type webhookDispatcher struct {
+	js      jetstream.JetStream
+	client  *http.Client
+	secret  []byte
+	consume jetstream.ConsumeContext
+}
+
+func newWebhookDispatcher(ctx context.Context, js jetstream.JetStream, secret string, maxDeliver int) (*webhookDispatcher, error) {
+	// The results are removed once delivered or dropped
+	err := ensureWorkQueueStream(ctx, js, jetstream.StreamConfig{
+		Name:     WEBHOOK_STREAM_NAME,
+		Subjects: []string{WEBHOOK_SUBJECT},
+		MaxAge:   WEBHOOK_MAX_AGE,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	consumer, err := js.CreateOrUpdateConsumer(ctx, WEBHOOK_STREAM_NAME, jetstream.ConsumerConfig{
+		Durable:    WEBHOOK_CONSUMER_NAME,
+		AckPolicy:  jetstream.AckExplicitPolicy,
+		AckWait:    2 * WEBHOOK_TIMEOUT,
+		MaxDeliver: maxDeliver,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer %s: %w", WEBHOOK_CONSUMER_NAME, err)
+	}
+
+	d := &webhookDispatcher{
+		js:     js,
+		client: &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		secret: []byte(secret),
+	}
+
+	d.consume, err = consumer.Consume(func(msg jetstream.Msg) {
+		d.handle(msg, maxDeliver)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume from %s: %w", WEBHOOK_CONSUMER_NAME, err)
+	}
+
+	return d, nil
+}
+
+// signWebhook returns the HMAC-SHA256 of the body with the secret
+func signWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// enqueue keeps the result of the script in the stream until it's delivered
+func (d *webhookDispatcher) enqueue(ctx context.Context, m *executor.Message, scr *script.Script, res *executor.ScriptResult) error {
+	data, err := json.Marshal(&webhookDelivery{
+		Name:    scr.Name,
+		Result:  res,
+		Subject: m.Subject,
+		Time:    time.Now(),
+		URL:     scr.DeliverTo,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to serialize webhook: %w", err)
+	}
+
+	_, err = d.js.Publish(ctx, WEBHOOK_SUBJECT, data)
+	if err != nil {
+		return fmt.Errorf("failed to publish webhook: %w", err)
+	}
+
+	return nil
+}
+
+// handle POSTs the result to the endpoint, the message is redelivered with an increasing delay when it fails
+func (d *webhookDispatcher) handle(msg jetstream.Msg, maxDeliver int) {
+	ctx, span := mainTracer.Start(context.Background(), "webhook.deliver", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	var delivered uint64 = 1
+	meta, err := msg.Metadata()
+	if err == nil {
+		delivered = meta.NumDelivered
+	}
+	span.SetAttributes(attribute.Int64("webhook.delivered", int64(delivered)))
+
+	wh := new(webhookDelivery)
+	err = json.Unmarshal(msg.Data(), wh)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Invalid webhook")
+		log.Errorf("failed to decode webhook, dropping it: %v", err)
+
+		msg.Term()
+		return
+	}
+
+	fields := log.Fields{
+		"subject":   wh.Subject,
+		"name":      wh.Name,
+		"url":       wh.URL,
+		"delivered": delivered,
+	}
+	span.SetAttributes(attribute.String("webhook.url", wh.URL), attribute.String("script.name", wh.Name))
+
+	err = d.post(ctx, wh)
+	if err == nil {
+		span.SetStatus(codes.Ok, "Webhook delivered")
+		log.WithFields(fields).Debug("webhook delivered")
+
+		err = msg.Ack()
+		if err != nil {
+			log.WithFields(fields).Errorf("failed to ack webhook: %v", err)
+		}
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	if maxDeliver > 0 && delivered >= uint64(maxDeliver) {
+		log.WithFields(fields).Errorf("failed to deliver webhook on its last attempt, dropping it: %v", err)
+		msg.Term()
+		return
+	}
+
+	log.WithFields(fields).Warnf("failed to deliver webhook, it will be retried: %v", err)
+	err = msg.NakWithDelay(streamNakDelay(delivered))
+	if err != nil {
+		log.WithFields(fields).Errorf("failed to nak webhook: %v", err)
+	}
+}
+
+func (d *webhookDispatcher) post(ctx context.Context, wh *webhookDelivery) error {
+	body, err := json.Marshal(wh.Result)
+	if err != nil {
+		return fmt.Errorf("failed to serialize result: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_SUBJECT_HEADER, wh.Subject)
+	req.Header.Set(WEBHOOK_NAME_HEADER, wh.Name)
+	if len(d.secret) > 0 {
+		req.Header.Set(WEBHOOK_SIGNATURE_HEADER, signWebhook(d.secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint replied with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Stop stops delivering the webhooks, the remaining ones stay in the stream
+func (d *webhookDispatcher) Stop() {
+	d.consume.Stop()
+}
+
+// deliverWebhook queues the result of the script to be delivered to its endpoint. Results of scripts that ran
+// on another instance aren't delivered.
+func (h *messageHandler) deliverWebhook(ctx context.Context, m *executor.Message, scr *script.Script, res *executor.ScriptResult) {
+	if scr.DeliverTo == "" || res.Error == (&executor.LockNotAcquiredError{}).Error() {
+		return
+	}
+
+	fields := log.Fields{
+		"subject": m.Subject,
+		"name":    scr.Name,
+		"url":     scr.DeliverTo,
+	}
+
+	if h.webhooks == nil {
+		log.WithFields(fields).Error("webhooks are disabled, result will not be delivered")
+		return
+	}
+
+	err := h.webhooks.enqueue(ctx, m, scr, res)
+	if err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		log.WithFields(fields).Errorf("failed to queue webhook: %v", err)
+	}
+}
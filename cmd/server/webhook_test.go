@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/numkem/msgscript/executor"
+)
+
+func TestWebhookPost(t *testing.T) {
+	var body []byte
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		body, _ = io.ReadAll(r.Body)
+		header = r.Header
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	d := &webhookDispatcher{client: srv.Client(), secret: []byte("secret")}
+	err := d.post(context.Background(), &webhookDelivery{
+		Name:    "hook",
+		Result:  &executor.ScriptResult{Name: "hook", Payload: []byte("done")},
+		Subject: "orders",
+		URL:     srv.URL,
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "orders", header.Get(WEBHOOK_SUBJECT_HEADER))
+	assert.Equal(t, signWebhook([]byte("secret"), body), header.Get(WEBHOOK_SIGNATURE_HEADER))
+	assert.NotEqual(t, signWebhook([]byte("other"), body), header.Get(WEBHOOK_SIGNATURE_HEADER))
+
+	// Failures are reported so the webhook is retried
+	err = d.post(context.Background(), &webhookDelivery{Result: &executor.ScriptResult{}, URL: srv.URL + "/fail"})
+	assert.NotNil(t, err)
+}
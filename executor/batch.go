@@ -0,0 +1,75 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/numkem/msgscript/script"
+)
+
+// BatchMessage is how each message of a batch is passed to the WASM modules and Podman containers
+type BatchMessage struct {
+	Headers map[string]string `json:"headers"`
+	Payload string            `json:"payload"`
+	Subject string            `json:"subject"`
+}
+
+// batchResultsWithError returns the same error as the result of every message of the batch
+func batchResultsWithError(size int, err string) []*ScriptResult {
+	results := make([]*ScriptResult, size)
+	for i := range results {
+		results[i] = &ScriptResult{Error: err}
+	}
+
+	return results
+}
+
+// handleBatchAsJSON runs the script once with a JSON array of the messages as payload. When the script outputs a
+// JSON array with an element per message, each message gets its element as reply, otherwise they all get the output.
+func handleBatchAsJSON(ctx context.Context, exec Executor, msgs []*Message, scr *script.Script) []*ScriptResult {
+	batch := make([]*BatchMessage, len(msgs))
+	for i, msg := range msgs {
+		batch[i] = &BatchMessage{
+			Headers: msg.Headers,
+			Payload: string(msg.Payload),
+			Subject: msg.Subject,
+		}
+	}
+
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return batchResultsWithError(len(msgs), err.Error())
+	}
+
+	res := exec.HandleMessage(ctx, &Message{Subject: scr.Subject, Payload: payload, Raw: true}, scr)
+	if res.Error != "" {
+		return batchResultsWithError(len(msgs), res.Error)
+	}
+
+	results := make([]*ScriptResult, len(msgs))
+
+	var replies []json.RawMessage
+	err = json.Unmarshal(res.Payload, &replies)
+	if err != nil || len(replies) != len(msgs) {
+		for i := range results {
+			r := *res
+			results[i] = &r
+		}
+
+		return results
+	}
+
+	for i, reply := range replies {
+		r := *res
+		r.Payload = reply
+
+		// Strings are replied without their quotes
+		var s string
+		if json.Unmarshal(reply, &s) == nil {
+			r.Payload = []byte(s)
+		}
+		results[i] = &r
+	}
+
+	return results
+}
@@ -2,8 +2,10 @@ package executor
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go"
@@ -20,14 +22,63 @@ const (
 	EXECUTOR_PODMAN_NAME = "podman"
 )
 
+// Aggregation modes of the results when multiple scripts handle the same message
+const (
+	// Every result in the order the scripts finished
+	AGGREGATE_ALL = "all"
+	// Only the first successful result
+	AGGREGATE_FIRST_SUCCESS = "first-success"
+	// Every result ordered by the name of the scripts
+	AGGREGATE_ORDERED_BY_NAME = "ordered-by-name"
+	// A single result with the JSON object payloads deep-merged
+	AGGREGATE_MERGE_JSON = "merge-json"
+)
+
 type Message struct {
-	Async    bool   `json:"async"`
-	Executor string `json:"executor"`
-	Method   string `json:"method"`
-	Payload  []byte `json:"payload"`
-	Raw      bool   `json:"raw"`
-	Subject  string `json:"subject"`
-	URL      string `json:"url"`
+	Aggregate string `json:"aggregate"`
+	Async     bool   `json:"async"`
+	Executor  string `json:"executor"`
+	// Headers of the NATS message (or HTTP request when coming from the HTTP handler)
+	Headers map[string]string `json:"headers"`
+	Method  string            `json:"method"`
+	Payload []byte            `json:"payload"`
+	Raw     bool              `json:"raw"`
+	// Only set by the server for the runs of the scheduler, a message sent by a client can't be scheduled
+	Scheduled bool   `json:"-"`
+	Subject   string `json:"subject"`
+	URL       string `json:"url"`
+}
+
+// ParseMessage decodes the data received from NATS into a Message along with its headers
+func ParseMessage(subject string, data []byte, header nats.Header) *Message {
+	m := new(Message)
+	err := json.Unmarshal(data, m)
+	// if the payload isn't a JSON Message, take it as a whole
+	if err != nil {
+		m.Subject = subject
+		m.Payload = data
+		m.Raw = true
+	}
+
+	// The above unmarshalling only applies to the structure of the JSON.
+	// Even if you feed it another JSON where none of the keys matches,
+	// it will just end up being an empty struct
+	if m.Payload == nil {
+		m = &Message{
+			Subject: subject,
+			Payload: data,
+		}
+	}
+
+	// The NATS headers are added to the ones that came from the HTTP handler
+	if len(header) > 0 && m.Headers == nil {
+		m.Headers = make(map[string]string)
+	}
+	for k := range header {
+		m.Headers[k] = header.Get(k)
+	}
+
+	return m
 }
 
 type ScriptResult struct {
@@ -35,7 +86,10 @@ type ScriptResult struct {
 	Error   string            `json:"error"`
 	Headers map[string]string `json:"http_headers"`
 	IsHTML  bool              `json:"is_html"`
+	Name    string            `json:"name"`
 	Payload []byte            `json:"payload"`
+	// The script returned the code as the HTTP status of its reply, unlike the exit code of a container
+	HTTPStatus bool `json:"http_status,omitempty"`
 }
 
 func ScriptResultWithError(err error) *ScriptResult {
@@ -48,6 +102,100 @@ func (e *NoScriptFoundError) Error() string {
 	return "No script found for subject"
 }
 
+type LockNotAcquiredError struct{}
+
+func (e *LockNotAcquiredError) Error() string {
+	return "cannot get lock"
+}
+
+// LockKey returns the key of the lock taken to run a broadcast script, scripts of different subjects can have the
+// same name
+func LockKey(scr *script.Script) string {
+	return strings.Join([]string{scr.Subject, scr.Name}, "/")
+}
+
+type lockHeldKey struct{}
+
+// WithLockHeld tells the executors that the caller already holds the lock of the script for the run
+func WithLockHeld(ctx context.Context) context.Context {
+	return context.WithValue(ctx, lockHeldKey{}, true)
+}
+
+func lockHeld(ctx context.Context) bool {
+	held, _ := ctx.Value(lockHeldKey{}).(bool)
+	return held
+}
+
+type RateLimitedError struct{}
+
+func (e *RateLimitedError) Error() string {
+	return "rate limit exceeded"
+}
+
+type OverloadedError struct{}
+
+func (e *OverloadedError) Error() string {
+	return "too many scripts running, try again later"
+}
+
+// Resources of a Lua script that can be limited
+const (
+	LIMIT_CALL_STACK   = "call stack"
+	LIMIT_INSTRUCTIONS = "instructions"
+	LIMIT_MEMORY       = "memory"
+	LIMIT_REGISTRY     = "registry"
+)
+
+// LimitExceededError is returned when a script used more of a resource than its limit allows
+type LimitExceededError struct {
+	Limit string
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("script exceeded its %s limit", e.Limit)
+}
+
+type DuplicateInProgressError struct{}
+
+func (e *DuplicateInProgressError) Error() string {
+	return "the same message is already being handled, try again later"
+}
+
+type CircuitOpenError struct{}
+
+func (e *CircuitOpenError) Error() string {
+	return "circuit breaker open, script is failing repeatedly"
+}
+
+// withScriptTimeout bounds the context with the timeout of the script, or the default one when the script doesn't
+// define it. A default of 0 means no timeout. The deadline of the caller is kept when it comes first.
+func withScriptTimeout(ctx context.Context, scr *script.Script, defaultTimeout time.Duration) (context.Context, context.CancelFunc) {
+	timeout := defaultTimeout
+	if scr.Timeout > 0 {
+		timeout = scr.Timeout
+	}
+
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// headersJSON encodes the headers of the message for the executors passing them through the environment
+func headersJSON(headers map[string]string) string {
+	if headers == nil {
+		return "{}"
+	}
+
+	j, err := json.Marshal(headers)
+	if err != nil {
+		return "{}"
+	}
+
+	return string(j)
+}
+
 // Used by executors
 func createTempFile(pattern string) (*os.File, error) {
 	tmpFile, err := os.CreateTemp(os.TempDir(), pattern)
@@ -60,13 +208,15 @@ func createTempFile(pattern string) (*os.File, error) {
 
 type Executor interface {
 	HandleMessage(context.Context, *Message, *script.Script) *ScriptResult
+	// HandleBatch runs the script once for all the messages, returning the result of each message in the same order
+	HandleBatch(context.Context, []*Message, *script.Script) []*ScriptResult
 	Stop()
 }
 
-func StartAllExecutors(ctx context.Context, scriptStore store.ScriptStore, plugins []plugins.PreloadFunc, nc *nats.Conn) map[string]Executor {
+func StartAllExecutors(ctx context.Context, scriptStore store.ScriptStore, plugins []plugins.PreloadFunc, nc *nats.Conn, luaOpts LuaOptions) map[string]Executor {
 	executors := make(map[string]Executor)
 
-	executors[EXECUTOR_LUA_NAME] = NewLuaExecutor(ctx, scriptStore, plugins, nc)
+	executors[EXECUTOR_LUA_NAME] = NewLuaExecutor(ctx, scriptStore, plugins, nc, luaOpts)
 	executors[EXECUTOR_WASM_NAME] = NewWasmExecutor(ctx, scriptStore, nil, nil)
 
 	podmanExec, err := NewPodmanExecutor(ctx, scriptStore)
@@ -0,0 +1,306 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/numkem/msgscript/script"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+const (
+	// How many initialized Lua states are kept for each script between its runs
+	LUA_STATE_POOL_SIZE = 8
+	// How often the libraries of a compiled script are compared with the ones of the store
+	LUA_LIBRARIES_CHECK_INTERVAL = 10 * time.Second
+)
+
+// luaState is a Lua state along with its working directory
+type luaState struct {
+	*lua.LState
+	workdir *luaWorkdir
+	globals map[lua.LValue]lua.LValue // The globals once the top level of the script ran
+}
+
+// snapshot keeps the globals set up by the top level of the script so they can be restored after each message
+func (L *luaState) snapshot() {
+	L.globals = make(map[lua.LValue]lua.LValue)
+	L.G.Global.ForEach(func(k, v lua.LValue) {
+		L.globals[k] = v
+	})
+}
+
+// restore puts back the globals of the snapshot, so a message doesn't see the ones set by the previous messages.
+// The tables aren't copied, the changes made to their fields are kept.
+func (L *luaState) restore() {
+	var added []lua.LValue
+	L.G.Global.ForEach(func(k, v lua.LValue) {
+		if old, found := L.globals[k]; !found || old != v {
+			added = append(added, k)
+		}
+	})
+
+	for _, k := range added {
+		L.G.Global.RawSet(k, lua.LNil)
+		if v, found := L.globals[k]; found {
+			L.G.Global.RawSet(k, v)
+		}
+	}
+}
+
+// compiledScript is a script compiled along with the Lua states that already ran it, ready to handle the next
+// messages. It stays in use until the script changes in the store, or the libraries it needs change.
+type compiledScript struct {
+	mu       sync.Mutex
+	content  []byte
+	required []string // Libraries of the require header, in its order
+	caps     luaCapabilities
+	limits   script.Limits
+	proto    *lua.FunctionProto
+	libs     map[string]*lua.FunctionProto // Libraries compiled for the script or required by it
+	sources  map[string][]byte             // Sources of the libraries, to find out when they change
+	checked  time.Time                     // When the libraries were last compared with the store
+	idle     []*luaState
+	evicted  bool
+}
+
+// matches tells if the script was compiled from the same content, libraries header, capabilities and limits
+func (cs *compiledScript) matches(scr *script.Script, caps luaCapabilities, limits script.Limits) bool {
+	return bytes.Equal(cs.content, scr.Content) && slices.Equal(cs.required, scr.LibKeys) &&
+		maps.Equal(cs.caps, caps) && cs.limits == limits
+}
+
+// checkDue tells if the libraries should be compared with the store, it's only done once per interval
+func (cs *compiledScript) checkDue() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return time.Since(cs.checked) >= LUA_LIBRARIES_CHECK_INTERVAL
+}
+
+// sameLibraries tells if the libraries read from the store are the ones the script was compiled with
+func (cs *compiledScript) sameLibraries(libs map[string][]byte) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if len(libs) != len(cs.sources) {
+		return false
+	}
+	for name, source := range libs {
+		if old, found := cs.sources[name]; !found || !bytes.Equal(old, source) {
+			return false
+		}
+	}
+
+	cs.checked = time.Now()
+	return true
+}
+
+// library returns the compiled library, nil when the script didn't need it yet
+func (cs *compiledScript) library(name string) *lua.FunctionProto {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return cs.libs[name]
+}
+
+// addLibrary keeps a library the script required while it ran, the next states get it without reading the store
+func (cs *compiledScript) addLibrary(name string, source []byte, proto *lua.FunctionProto) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.libs[name] = proto
+	cs.sources[name] = source
+}
+
+// libraryNames returns the names of the libraries of the script, sorted
+func (cs *compiledScript) libraryNames() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return sortedKeys(cs.libs)
+}
+
+// acquire returns an idle state that already ran the script, nil when there isn't any
+func (cs *compiledScript) acquire() *luaState {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if len(cs.idle) == 0 {
+		return nil
+	}
+
+	L := cs.idle[len(cs.idle)-1]
+	cs.idle = cs.idle[:len(cs.idle)-1]
+	return L
+}
+
+// release puts the state back in the pool, it is closed if the pool is full or the script changed
+func (cs *compiledScript) release(L *luaState) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.evicted || len(cs.idle) >= LUA_STATE_POOL_SIZE {
+		L.Close()
+		return
+	}
+
+	// Only the values returned by the last call are left on the stack
+	L.SetTop(0)
+	L.restore()
+	cs.idle = append(cs.idle, L)
+}
+
+func (cs *compiledScript) evict() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.evicted = true
+	for _, L := range cs.idle {
+		L.Close()
+	}
+	cs.idle = nil
+}
+
+// luaScriptCache keeps the compiled scripts by subject and name
+type luaScriptCache struct {
+	mu      sync.Mutex
+	scripts map[string]*compiledScript
+}
+
+func newLuaScriptCache() *luaScriptCache {
+	return &luaScriptCache{scripts: make(map[string]*compiledScript)}
+}
+
+func luaCacheKey(subject, name string) string {
+	return strings.Join([]string{subject, name}, "/")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// compileLua compiles the source of a script or a library, the errors it raises start with its name and the line
+func compileLua(name string, source []byte) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(bytes.NewReader(source), name)
+	if err != nil {
+		return nil, err
+	}
+
+	return lua.Compile(chunk, name)
+}
+
+// get returns the compiled script, compiling it and its libraries if the script isn't cached or has changed.
+// Warm runs don't read the store: the scripts changing in the store are evicted as they change, and their libraries
+// are only compared with the store once per LUA_LIBRARIES_CHECK_INTERVAL. The libraries required while the script
+// runs are kept along with the ones of the header, requiring a new one doesn't compile the script again.
+// The second value tells if the script was compiled.
+func (c *luaScriptCache) get(ctx context.Context, store msgstore.ScriptStore, key string, scr *script.Script, caps luaCapabilities, limits script.Limits) (*compiledScript, bool, error) {
+	c.mu.Lock()
+	cs, found := c.scripts[key]
+	c.mu.Unlock()
+	if found && cs.matches(scr, caps, limits) && !cs.checkDue() {
+		return cs, false, nil
+	}
+
+	// Load the libraries of the header along with the ones the script required on its previous runs
+	names := slices.Clone(scr.LibKeys)
+	if found {
+		names = append(names, cs.libraryNames()...)
+	}
+	_, libSpan := luaTracer.Start(ctx, "lua.load_libraries",
+		trace.WithAttributes(
+			attribute.Int("library_count", len(names)),
+		),
+	)
+	libs, err := loadLibraries(ctx, store, names)
+	if err != nil {
+		libSpan.RecordError(err)
+		libSpan.SetStatus(codes.Error, "Failed to load libraries")
+		libSpan.End()
+
+		return nil, false, fmt.Errorf("failed to read librairies: %w", err)
+	}
+	libSpan.SetStatus(codes.Ok, "")
+	libSpan.End()
+
+	if found && cs.matches(scr, caps, limits) && cs.sameLibraries(libs) {
+		return cs, false, nil
+	}
+
+	proto, err := compileLua(scr.Name, scr.Content)
+	if err != nil {
+		return nil, false, err
+	}
+	protos := make(map[string]*lua.FunctionProto)
+	for lib, source := range libs {
+		protos[lib], err = compileLua(lib, source)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to compile library %s: %w", lib, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another message could have compiled it in the meantime
+	if cs, found := c.scripts[key]; found {
+		if cs.matches(scr, caps, limits) && cs.sameLibraries(libs) {
+			return cs, false, nil
+		}
+		cs.evict()
+	}
+
+	cs = &compiledScript{
+		content:  slices.Clone(scr.Content),
+		required: slices.Clone(scr.LibKeys),
+		caps:     caps,
+		limits:   limits,
+		proto:    proto,
+		libs:     protos,
+		sources:  libs,
+		checked:  time.Now(),
+	}
+	c.scripts[key] = cs
+	return cs, true, nil
+}
+
+// evict removes the script from the cache, closing its idle states
+func (c *luaScriptCache) evict(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cs, found := c.scripts[key]; found {
+		cs.evict()
+		delete(c.scripts, key)
+	}
+}
+
+func (c *luaScriptCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, cs := range c.scripts {
+		cs.evict()
+		delete(c.scripts, key)
+	}
+}
@@ -0,0 +1,138 @@
+package executor
+
+import (
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Gives every library and module to the script
+const LUA_CAPABILITY_ALL = "all"
+
+// Libraries of the standard library only given to the scripts with their capability, the others are
+// always available
+var luaRestrictedLibs = []string{lua.IoLibName, lua.OsLibName, lua.DebugLibName}
+
+// Functions of the os library kept for the scripts without the os capability
+var luaSafeOsFuncs = []string{"clock", "date", "difftime", "time"}
+
+// luaCapabilities are the restricted libraries and the modules a script can use, nil allows everything
+type luaCapabilities map[string]bool
+
+// scriptCapabilities returns what the script can use: the capabilities it asks for that the server allows,
+// or all the ones the server allows when it doesn't ask for any
+func scriptCapabilities(server, scr []string) luaCapabilities {
+	var caps luaCapabilities
+	for _, list := range [][]string{server, scr} {
+		if len(list) == 0 || contains(list, LUA_CAPABILITY_ALL) {
+			continue
+		}
+
+		allowed := make(luaCapabilities)
+		for _, c := range list {
+			if caps == nil || caps[c] {
+				allowed[c] = true
+			}
+		}
+		caps = allowed
+	}
+
+	return caps
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c luaCapabilities) allows(name string) bool {
+	return c == nil || c[name]
+}
+
+func (c luaCapabilities) String() string {
+	if c == nil {
+		return LUA_CAPABILITY_ALL
+	}
+
+	var names []string
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+// apply removes the libraries and modules the script isn't allowed to use from the state. Requiring them raises
+// an error instead.
+func (c luaCapabilities) apply(L *lua.LState) {
+	if c == nil {
+		return
+	}
+
+	pkg, ok := L.GetGlobal(lua.LoadLibName).(*lua.LTable)
+	if !ok {
+		return
+	}
+	preload, _ := pkg.RawGetString("preload").(*lua.LTable)
+	loaded, _ := L.GetField(L.Get(lua.RegistryIndex), "_LOADED").(*lua.LTable)
+	if preload == nil || loaded == nil {
+		return
+	}
+
+	deny := func(name string) {
+		preload.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+			L.RaiseError("module '%s' is not allowed by the capabilities of the script", name)
+			return 0
+		}))
+	}
+
+	osLib, _ := L.GetGlobal(lua.OsLibName).(*lua.LTable)
+	for _, name := range luaRestrictedLibs {
+		if c.allows(name) {
+			continue
+		}
+
+		L.SetGlobal(name, lua.LNil)
+		loaded.RawSetString(name, lua.LNil)
+		deny(name)
+	}
+
+	if !c.allows(lua.OsLibName) && osLib != nil {
+		os := L.NewTable()
+		for _, name := range luaSafeOsFuncs {
+			os.RawSetString(name, osLib.RawGetString(name))
+		}
+		L.SetGlobal(lua.OsLibName, os)
+		loaded.RawSetString(lua.OsLibName, os)
+	}
+
+	// Files can only be read with the io capability
+	if !c.allows(lua.IoLibName) {
+		L.SetGlobal("dofile", lua.LNil)
+		L.SetGlobal("loadfile", lua.LNil)
+
+		// Only the preloaded modules can be required, not the Lua files found on package.path
+		if loaders, ok := pkg.RawGetString("loaders").(*lua.LTable); ok {
+			for loaders.Len() > 1 {
+				loaders.Remove(loaders.Len())
+			}
+		}
+	}
+
+	var names []string
+	preload.ForEach(func(k, _ lua.LValue) {
+		names = append(names, lua.LVAsString(k))
+	})
+	for _, name := range names {
+		if !c.allows(name) && !contains(luaRestrictedLibs, name) {
+			deny(name)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/cjoudrey/gluahttp"
@@ -34,24 +35,89 @@ type LuaExecutor struct {
 	nc         *nats.Conn               // Connection to NATS
 	store      msgstore.ScriptStore     // Interface for the script storage backend
 	plugins    []msgplugins.PreloadFunc // Plugins to load before execution
+	scripts    *luaScriptCache          // Compiled scripts and their idle Lua states
+	dataDir    string                   // Where the persistent working directories of the scripts are
+	caps       []string                 // Capabilities allowed to the scripts
+	limits     script.Limits            // Resources the scripts can use at most
+}
+
+// LuaOptions are the settings of the Lua executor shared by all the scripts
+type LuaOptions struct {
+	// DataDir holds the persistent working directories of the scripts, defaults to msgscript-data in the
+	// temporary directory
+	DataDir string
+	// Capabilities are the libraries and modules the scripts are allowed to use, empty allows everything
+	Capabilities []string
+	// Limits bound the resources used by every script, the ones set by a script can only be lower
+	Limits script.Limits
 }
 
 // NewLuaExecutor creates a new ScriptExecutor using the provided ScriptStore
-func NewLuaExecutor(c context.Context, store msgstore.ScriptStore, plugins []msgplugins.PreloadFunc, nc *nats.Conn) Executor {
+func NewLuaExecutor(c context.Context, store msgstore.ScriptStore, plugins []msgplugins.PreloadFunc, nc *nats.Conn, opts LuaOptions) Executor {
 	ctx, cancelFunc := context.WithCancel(c)
 
-	return &LuaExecutor{
+	if opts.DataDir == "" {
+		opts.DataDir = filepath.Join(os.TempDir(), "msgscript-data")
+	}
+
+	le := &LuaExecutor{
 		cancelFunc: cancelFunc,
 		ctx:        ctx,
 		nc:         nc,
 		store:      store,
 		plugins:    plugins,
+		scripts:    newLuaScriptCache(),
+		dataDir:    opts.DataDir,
+		caps:       opts.Capabilities,
+		limits:     opts.Limits,
 	}
+
+	// Changed scripts are compiled again on their next run, their idle states are closed right away
+	go store.WatchScripts(ctx, "", func(subject, name string, _ []byte, _ bool) {
+		le.scripts.evict(luaCacheKey(subject, name))
+	})
+
+	return le
 }
 
 // HandleMessage receives a message, matches it to a Lua script, and executes the script in a new goroutine
 // Run the Lua script in a separate goroutine to handle the message for each script
 func (le *LuaExecutor) HandleMessage(ctx context.Context, msg *Message, scr *script.Script) *ScriptResult {
+	return le.run(ctx, msg, scr, func(ctx context.Context, fields log.Fields, L *lua.LState) *ScriptResult {
+		if scr.HTML {
+			// If the message is set to return HTML, we pass 2 things to the fonction named after the HTTP
+			// method received ex: POST(), GET()...
+			// The 2 things are:
+			//   - The URL part after the function name
+			//   - The body of the HTTP call
+			return le.executeHTMLMessage(ctx, fields, L, msg, scr.Name)
+		}
+
+		// If we do not have an HTML based message, we call the function named
+		// OnMessage() with 2 parameters:
+		//   - The subject
+		//   - The body of the message
+		return le.executeRawMessage(ctx, fields, L, msg, scr.Name)
+	})
+}
+
+// HandleBatch calls the OnBatch function of the script once with all the messages
+func (le *LuaExecutor) HandleBatch(ctx context.Context, msgs []*Message, scr *script.Script) []*ScriptResult {
+	var results []*ScriptResult
+	res := le.run(ctx, &Message{Subject: scr.Subject}, scr, func(ctx context.Context, fields log.Fields, L *lua.LState) *ScriptResult {
+		var res *ScriptResult
+		results, res = le.executeBatch(ctx, fields, L, msgs, scr.Name)
+		return res
+	})
+	if results == nil {
+		return batchResultsWithError(len(msgs), res.Error)
+	}
+
+	return results
+}
+
+// run prepares a Lua state with the script loaded and calls the function handling the message(s) with it
+func (le *LuaExecutor) run(ctx context.Context, msg *Message, scr *script.Script, call func(ctx context.Context, fields log.Fields, L *lua.LState) *ScriptResult) *ScriptResult {
 	ctx, span := luaTracer.Start(ctx, "lua.handle_message",
 		trace.WithAttributes(
 			attribute.String("subject", msg.Subject),
@@ -83,89 +149,148 @@ func (le *LuaExecutor) HandleMessage(ctx context.Context, msg *Message, scr *scr
 
 	res := new(ScriptResult)
 
-	tmp, err := os.MkdirTemp(os.TempDir(), "msgscript-lua-*s")
+	// Each run gets its own working directory, the working directory of the server is left untouched
+	workdir, removeWorkdir, err := scriptWorkdir(le.dataDir, scr)
 	if err != nil {
 		scriptSpan.RecordError(err)
-		scriptSpan.SetStatus(codes.Error, "Failed to create temp directory")
+		scriptSpan.SetStatus(codes.Error, "Failed to create working directory")
 
-		res.Error = fmt.Sprintf("failed to create temp directory: %w", err)
-		return nil
+		res.Error = err.Error()
+		return res
 	}
-	defer os.RemoveAll(tmp)
+	defer removeWorkdir()
+	scriptSpan.SetAttributes(attribute.String("workdir", workdir))
+
+	key := luaCacheKey(scr.Subject, scr.Name)
+
+	// Scripts delivered through a queue group or a stream are only received by a single instance so they don't need locking
+	if !scr.Exclusive() && !lockHeld(ctx) {
+		// Acquire lock
+		_, lockSpan := luaTracer.Start(ctx, "lua.acquire_lock",
+			trace.WithAttributes(
+				attribute.String("lock.name", LockKey(scr)),
+			),
+		)
+		defer lockSpan.End()
+
+		locked, err := le.store.TakeLock(ctx, LockKey(scr))
+		if err != nil {
+			lockSpan.RecordError(err)
+			lockSpan.SetStatus(codes.Error, "Failed to acquire lock")
 
-	err = os.Chdir(tmp)
-	if err != nil {
-		scriptSpan.RecordError(err)
-		scriptSpan.SetStatus(codes.Error, "Failed to change directory")
+			scriptSpan.RecordError(err)
+			scriptSpan.SetStatus(codes.Error, "Failed to acquire lock")
 
-		res.Error = fmt.Sprintf("failed to change to temp directory %s: %w", tmp, err)
-		return nil
-	}
-	scriptSpan.SetAttributes(attribute.String("temp_dir", tmp))
+			log.WithFields(fields).Debugf("failed to get lock: %s", err)
+			res.Error = fmt.Sprintf("failed to get lock: %s", err)
+			return res
+		}
 
-	// Load libraries
-	_, libSpan := luaTracer.Start(ctx, "lua.load_libraries",
-		trace.WithAttributes(
-			attribute.Int("library_count", len(scr.LibKeys)),
-		),
-	)
-	defer libSpan.End()
-	libs, err := le.store.LoadLibrairies(ctx, scr.LibKeys)
-	if err != nil {
-		libSpan.RecordError(err)
-		libSpan.SetStatus(codes.Error, "Failed to load libraries")
+		if !locked {
+			lockSpan.SetStatus(codes.Error, "Lock not acquired")
 
-		scriptSpan.RecordError(err)
-		scriptSpan.SetStatus(codes.Error, "Failed to load libraries")
+			scriptSpan.SetStatus(codes.Error, "Could not acquire lock")
 
-		res.Error = fmt.Errorf("failed to read librairies: %w", err).Error()
-		return res
+			log.WithFields(fields).Debug("we don't have a lock, giving up")
+			res.Error = (&LockNotAcquiredError{}).Error()
+			return res
+		}
+		lockSpan.SetStatus(codes.Ok, "Lock acquired")
+
+		defer le.store.ReleaseLock(ctx, LockKey(scr))
 	}
-	libSpan.SetStatus(codes.Ok, "")
 
-	// Acquire lock
-	_, lockSpan := luaTracer.Start(ctx, "lua.acquire_lock",
-		trace.WithAttributes(
-			attribute.String("lock.name", scr.Name),
-		),
+	log.WithFields(fields).WithField("isHTML", scr.HTML).Debug("executing script")
+
+	caps := scriptCapabilities(le.caps, scr.Capabilities)
+	limits := scr.Limits.Within(le.limits)
+	scriptSpan.SetAttributes(
+		attribute.String("lua.capabilities", caps.String()),
+		attribute.Int("lua.limits.call_stack", limits.CallStack),
+		attribute.Int64("lua.limits.instructions", limits.Instructions),
+		attribute.Int64("lua.limits.memory", limits.Memory),
+		attribute.Int("lua.limits.registry", limits.Registry),
 	)
-	defer lockSpan.End()
 
-	locked, err := le.store.TakeLock(ctx, scr.Name)
+	// The script is only compiled again when it, its libraries, its capabilities or its limits changed
+	compiled, isNew, err := le.scripts.get(ctx, le.store, key, scr, caps, limits)
 	if err != nil {
-		lockSpan.RecordError(err)
-		lockSpan.SetStatus(codes.Error, "Failed to acquire lock")
-
 		scriptSpan.RecordError(err)
-		scriptSpan.SetStatus(codes.Error, "Failed to load libraries")
+		scriptSpan.SetStatus(codes.Error, "Script compile error")
 
-		log.WithFields(fields).Debugf("failed to get lock: %s", err)
-		res.Error = fmt.Sprintf("failed to get lock: %s", err)
+		log.WithFields(fields).Errorf("error compiling Lua script: %s", err)
+		res.Error = err.Error()
 		return res
 	}
+	scriptSpan.SetAttributes(
+		attribute.Bool("script.compiled", isNew),
+		attribute.Int("script.content_size", len(scr.Content)),
+	)
+	if isNew {
+		log.WithFields(fields).Debugf("script:\n%+s\n\n", scr.Content)
+	}
+
+	// The script is stopped once its timeout or the caller's deadline is reached
+	tctx, tcan := withScriptTimeout(ctx, scr, MAX_LUA_RUNNING_TIME)
+	defer tcan()
+	// Stopping the executor also stops the running scripts
+	stopOnExit := context.AfterFunc(le.ctx, tcan)
+	defer stopOnExit()
+	// The instructions and the memory are counted from the context of the state
+	bctx := newLuaBudget(tctx, limits)
+
+	// States that already ran the script skip its initialization
+	L := compiled.acquire()
+	scriptSpan.SetAttributes(attribute.Bool("lua.warm", L != nil))
+	if L != nil {
+		L.workdir.dir = workdir
+		attachBudget(bctx, L.LState)
+		L.SetContext(bctx)
+	} else {
+		L, err = le.newState(ctx, bctx, fields, workdir, caps, limits, compiled)
+		if err != nil {
+			if lerr := limitError(bctx, err.Error()); lerr != nil {
+				err = lerr
+			}
+			scriptSpan.RecordError(err)
+			scriptSpan.SetStatus(codes.Error, "Failed to initialize Lua state")
 
-	if !locked {
-		lockSpan.SetStatus(codes.Error, "Lock not acquired")
+			res.Error = err.Error()
+			return res
+		}
+	}
 
-		scriptSpan.SetStatus(codes.Error, "Could not acquire lock")
+	// Execute the appropriate message handler
+	res = call(ctx, fields, L.LState)
+	if res.Error != "" {
+		if lerr := limitError(bctx, res.Error); lerr != nil {
+			scriptSpan.RecordError(lerr)
+			log.WithFields(fields).Warn(lerr)
+			res.Error = lerr.Error()
+		}
+	}
 
-		log.WithFields(fields).Debug("we don't have a lock, giving up")
-		res.Error = "cannot get lock"
-		return res
+	// A state stopped in the middle of the script or that raised an error isn't reused
+	L.RemoveContext()
+	if res.Error == "" && tctx.Err() == nil {
+		compiled.release(L)
+	} else {
+		L.Close()
 	}
-	lockSpan.SetStatus(codes.Ok, "Lock acquired")
 
-	defer le.store.ReleaseLock(ctx, scr.Name)
+	scriptSpan.SetStatus(codes.Ok, "Script executed successfully")
 
-	log.WithFields(fields).WithField("isHTML", scr.HTML).Debug("executing script")
+	return res
+}
 
-	// Initialize Lua state
+// newState creates a Lua state with the modules, plugins and libraries the script is allowed to use and runs the
+// script in it
+func (le *LuaExecutor) newState(ctx, tctx context.Context, fields log.Fields, workdir string, caps luaCapabilities, limits script.Limits, compiled *compiledScript) (*luaState, error) {
 	_, luaInitSpan := luaTracer.Start(ctx, "lua.initialize_state")
-	L := lua.NewState()
-	tctx, tcan := context.WithTimeout(le.ctx, MAX_LUA_RUNNING_TIME)
-	defer tcan()
+	L := lua.NewState(luaStateOptions(limits))
+	attachBudget(tctx, L)
 	L.SetContext(tctx)
-	defer L.Close()
+	wd := &luaWorkdir{dir: workdir}
 
 	// Set up the Lua state with the subject and payload
 	L.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
@@ -177,65 +302,54 @@ func (le *LuaExecutor) HandleMessage(ctx context.Context, msg *Message, scr *scr
 
 	// Load plugins
 	if le.plugins != nil {
-		err = msgplugins.LoadPlugins(L, le.plugins)
+		err := msgplugins.LoadPlugins(L, le.plugins)
 		if err != nil {
 			luaInitSpan.RecordError(err)
 			luaInitSpan.SetStatus(codes.Error, "Failed to load plugins")
+			luaInitSpan.End()
+			L.Close()
 
-			scriptSpan.RecordError(err)
-			scriptSpan.SetStatus(codes.Error, "Failed to load plugins")
-
-			res.Error = fmt.Sprintf("failed to load plugin: %w", err)
-			return res
+			return nil, fmt.Errorf("failed to load plugin: %v", err)
 		}
 	}
-	luaInitSpan.SetStatus(codes.Ok, "")
-	luaInitSpan.End()
+	uncountedModules(L)
+	wd.install(L)
+	caps.apply(L)
+	libraries := &luaLibraries{compiled: compiled, store: le.store}
+	libraries.install(L)
+	err := libraries.requireHeader(L)
+	if err != nil {
+		luaInitSpan.RecordError(err)
+		luaInitSpan.SetStatus(codes.Error, "Failed to load libraries")
+		luaInitSpan.End()
+		L.Close()
 
-	// Build script content
-	var sb strings.Builder
-	for _, l := range libs {
-		sb.Write(l)
-		sb.WriteString("\n")
+		return nil, err
 	}
-	sb.Write(scr.Content)
-	scriptContent := sb.String()
-	scriptSpan.SetAttributes(attribute.Int("script.content_size", len(scriptContent)))
-	log.WithFields(fields).Debugf("script:\n%+s\n\n", scriptContent)
+	luaInitSpan.SetStatus(codes.Ok, "")
+	luaInitSpan.End()
 
 	// Execute Lua script
 	_, execSpan := luaTracer.Start(ctx, "lua.execute_script")
-	if err := L.DoString(scriptContent); err != nil {
-		scriptSpan.RecordError(err)
-		scriptSpan.SetStatus(codes.Error, "Script execute error")
+	defer execSpan.End()
 
-		msg := fmt.Sprintf("error executing Lua script: %s", err)
-		log.WithFields(fields).Errorf(msg)
-		res.Error = err.Error()
-		return nil
-	}
-	execSpan.SetStatus(codes.Ok, "")
-	execSpan.End()
+	L.Push(L.NewFunctionFromProto(compiled.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		execSpan.RecordError(err)
+		execSpan.SetStatus(codes.Error, "Script execute error")
 
-	// Execute the appropriate message handler
-	if scr.HTML {
-		// If the message is set to return HTML, we pass 2 things to the fonction named after the HTTP
-		// method received ex: POST(), GET()...
-		// The 2 things are:
-		//   - The URL part after the function name
-		//   - The body of the HTTP call
-		res = le.executeHTMLMessage(ctx, fields, L, msg, scr.Name)
-	} else {
-		// If we do not have an HTML based message, we call the function named
-		// OnMessage() with 2 parameters:
-		//   - The subject
-		//   - The body of the message
-		res = le.executeRawMessage(ctx, fields, L, msg, scr.Name)
+		log.WithFields(fields).Errorf("error executing Lua script: %s", err)
+		L.Close()
+
+		return nil, err
 	}
+	L.SetTop(0)
+	execSpan.SetStatus(codes.Ok, "")
 
-	scriptSpan.SetStatus(codes.Ok, "Script executed successfully")
+	state := &luaState{LState: L, workdir: wd}
+	state.snapshot()
 
-	return res
+	return state, nil
 }
 
 func (*LuaExecutor) executeHTMLMessage(ctx context.Context, fields log.Fields, L *lua.LState, msg *Message, name string) *ScriptResult {
@@ -259,7 +373,7 @@ func (*LuaExecutor) executeHTMLMessage(ctx context.Context, fields log.Fields, L
 			Fn:      gMethod,
 			NRet:    3,
 			Protect: true,
-		}, lua.LString(msg.URL), lua.LString(string(msg.Payload))); err != nil {
+		}, lua.LString(msg.URL), lua.LString(string(msg.Payload)), headersTable(L, msg.Headers)); err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, fmt.Sprintf("Failed to call %s function", msg.Method))
 
@@ -312,7 +426,14 @@ func (*LuaExecutor) executeRawMessage(ctx context.Context, fields log.Fields, L
 	res := new(ScriptResult)
 	log.WithFields(fields).Debug("Running standard script")
 
-	gOnMessage := L.GetGlobal("OnMessage")
+	// Scheduled runs call OnSchedule when the script defines it
+	fnName := "OnMessage"
+	if msg.Scheduled && L.GetGlobal("OnSchedule").Type() != lua.LTNil {
+		fnName = "OnSchedule"
+	}
+	span.SetAttributes(attribute.String("function", fnName))
+
+	gOnMessage := L.GetGlobal(fnName)
 	if gOnMessage.Type().String() == "nil" {
 		span.SetStatus(codes.Error, "OnMessage function not found")
 		res.Error = "failed to find global function named 'OnMessage'"
@@ -322,17 +443,28 @@ func (*LuaExecutor) executeRawMessage(ctx context.Context, fields log.Fields, L
 	// Call the "OnMessage" function
 	err := L.CallByParam(lua.P{
 		Fn:      gOnMessage,
-		NRet:    1,
+		NRet:    3,
 		Protect: true,
-	}, lua.LString(msg.Subject), lua.LString(string(msg.Payload)))
+	}, lua.LString(msg.Subject), lua.LString(string(msg.Payload)), headersTable(L, msg.Headers))
 	if err != nil {
 		span.RecordError(err)
-		span.SetStatus(codes.Error, "Failed to call OnMessage")
-		res.Error = fmt.Errorf("failed to call OnMessage function: %w", err).Error()
+		span.SetStatus(codes.Error, fmt.Sprintf("Failed to call %s", fnName))
+		res.Error = fmt.Errorf("failed to call %s function: %w", fnName, err).Error()
 		return res
 	}
 
-	result := L.Get(-1)
+	// Besides the payload, the function can optionally return a code and headers
+	// ex: return "unauthorized", 401, {}
+	res.Code = int(lua.LVAsNumber(L.Get(2)))
+	res.HTTPStatus = res.Code != 0
+	if ltable, ok := L.Get(3).(*lua.LTable); ok {
+		res.Headers = make(map[string]string)
+		ltable.ForEach(func(k, v lua.LValue) {
+			res.Headers[lua.LVAsString(k)] = lua.LVAsString(v)
+		})
+	}
+
+	result := L.Get(1)
 	val, ok := result.(lua.LString)
 	if ok {
 		res.Payload = []byte(val.String())
@@ -351,8 +483,115 @@ func (*LuaExecutor) executeRawMessage(ctx context.Context, fields log.Fields, L
 	return res
 }
 
+func (*LuaExecutor) executeBatch(ctx context.Context, fields log.Fields, L *lua.LState, msgs []*Message, name string) ([]*ScriptResult, *ScriptResult) {
+	_, span := luaTracer.Start(ctx, "lua.execute_batch",
+		trace.WithAttributes(
+			attribute.String("script.name", name),
+			attribute.Int("batch.size", len(msgs)),
+		),
+	)
+	defer span.End()
+
+	res := new(ScriptResult)
+	log.WithFields(fields).WithField("size", len(msgs)).Debug("Running batch script")
+
+	gOnBatch := L.GetGlobal("OnBatch")
+	if gOnBatch.Type() == lua.LTNil {
+		span.SetStatus(codes.Error, "OnBatch function not found")
+		res.Error = "failed to find global function named 'OnBatch'"
+		return nil, res
+	}
+
+	// Each message is a table with its subject, payload and headers
+	messages := L.NewTable()
+	for _, msg := range msgs {
+		t := L.NewTable()
+		t.RawSetString("subject", lua.LString(msg.Subject))
+		t.RawSetString("payload", lua.LString(string(msg.Payload)))
+		t.RawSetString("headers", headersTable(L, msg.Headers))
+		messages.Append(t)
+	}
+
+	err := L.CallByParam(lua.P{
+		Fn:      gOnBatch,
+		NRet:    1,
+		Protect: true,
+	}, messages)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to call OnBatch")
+		res.Error = fmt.Errorf("failed to call OnBatch function: %w", err).Error()
+		return nil, res
+	}
+
+	// The function returns either a table with the reply of each message, in the same order,
+	// or a single value replied to all of them
+	replies, ok := L.Get(1).(*lua.LTable)
+	if !ok || replies.Len() != len(msgs) {
+		reply := batchReply(L.Get(1))
+		results := make([]*ScriptResult, len(msgs))
+		for i := range results {
+			r := *reply
+			results[i] = &r
+		}
+
+		span.SetStatus(codes.Ok, "Batch executed")
+		return results, res
+	}
+
+	results := make([]*ScriptResult, len(msgs))
+	for i := range results {
+		results[i] = batchReply(replies.RawGetInt(i + 1))
+	}
+	span.SetStatus(codes.Ok, "Batch executed")
+
+	return results, res
+}
+
+// batchReply converts the reply of a message returned by OnBatch to a result. The reply is either the payload or
+// a table with the payload, code, headers and error.
+func batchReply(v lua.LValue) *ScriptResult {
+	res := new(ScriptResult)
+
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		if s, ok := v.(lua.LString); ok {
+			res.Payload = []byte(s.String())
+		}
+		return res
+	}
+
+	if s, ok := t.RawGetString("payload").(lua.LString); ok {
+		res.Payload = []byte(s.String())
+	}
+	res.Code = int(lua.LVAsNumber(t.RawGetString("code")))
+	res.HTTPStatus = res.Code != 0
+	if s, ok := t.RawGetString("error").(lua.LString); ok {
+		res.Error = s.String()
+	}
+	if headers, ok := t.RawGetString("headers").(*lua.LTable); ok {
+		res.Headers = make(map[string]string)
+		headers.ForEach(func(k, v lua.LValue) {
+			res.Headers[lua.LVAsString(k)] = lua.LVAsString(v)
+		})
+	}
+
+	return res
+}
+
+// headersTable converts the headers of the message to a Lua table
+func headersTable(L *lua.LState, headers map[string]string) *lua.LTable {
+	t := L.NewTable()
+	for k, v := range headers {
+		t.RawSetString(k, lua.LString(v))
+	}
+
+	return t
+}
+
 // Stop gracefully shuts down the ScriptExecutor and stops watching for messages
 func (se *LuaExecutor) Stop() {
 	se.cancelFunc()
+	se.scripts.close()
 	log.Debug("LuaExecutor stopped")
 }
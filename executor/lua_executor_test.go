@@ -0,0 +1,438 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/numkem/msgscript/script"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+// A library along the lines of the web one, big enough for its parsing to matter
+var benchLibrary = func() string {
+	var sb strings.Builder
+	sb.WriteString("local M = {}\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&sb, "function M.format%d(s)\n  return string.format(\"%%s-%d\", s)\nend\n", i, i)
+	}
+	sb.WriteString("return M\n")
+
+	return sb.String()
+}()
+
+const benchScript = `--* subject: bench
+--* name: bench
+--* require: helpers
+--* delivery: queue
+local json = require("json")
+local helpers = require("helpers")
+
+function OnMessage(subject, payload)
+  return json.encode({subject = subject, payload = helpers.format1(payload)})
+end
+`
+
+// newTestLuaExecutor returns an executor reading the libraries from an empty store, along with the script
+func newTestLuaExecutor(t testing.TB, content string) (*LuaExecutor, *script.Script) {
+	store, err := msgstore.NewDevStore("")
+	assert.Nil(t, err)
+
+	scr, err := script.ReadString(content)
+	assert.Nil(t, err)
+
+	le := NewLuaExecutor(context.Background(), store, nil, nil, LuaOptions{DataDir: t.TempDir()}).(*LuaExecutor)
+	t.Cleanup(le.Stop)
+
+	return le, scr
+}
+
+func TestLuaExecutorReusesStates(t *testing.T) {
+	le, scr := newTestLuaExecutor(t, `--* subject: counter
+--* name: counter
+--* delivery: queue
+runs = 0
+
+function OnMessage(subject, payload)
+  if payload == "lib" then
+    return require("lib")
+  end
+
+  runs = runs + 1
+  local before = tostring(last)
+  last = payload
+  return tostring(runs) .. " " .. before
+end
+`)
+	msg := &Message{Subject: "counter", Payload: []byte("a")}
+
+	// The state that ran the script is reused, with the globals as its top level set them up
+	assert.Equal(t, "1 nil", string(le.HandleMessage(context.Background(), msg, scr).Payload))
+	assert.Equal(t, "1 nil", string(le.HandleMessage(context.Background(), msg, scr).Payload))
+	assert.Len(t, le.scripts.scripts[luaCacheKey(scr.Subject, scr.Name)].idle, 1)
+
+	// Requiring a library while running doesn't compile the script again
+	le.store.AddLibrary(context.Background(), []byte(`return "lib"`), "lib")
+	compiled := le.scripts.scripts[luaCacheKey(scr.Subject, scr.Name)]
+	for range 2 {
+		res := le.HandleMessage(context.Background(), &Message{Subject: "counter", Payload: []byte("lib")}, scr)
+		assert.Equal(t, "lib", string(res.Payload))
+	}
+	assert.Same(t, compiled, le.scripts.scripts[luaCacheKey(scr.Subject, scr.Name)])
+
+	// A new revision starts from fresh states
+	changed := *scr
+	changed.Content = []byte(strings.Replace(string(scr.Content), "runs + 1", "runs + 10", 1))
+	assert.Equal(t, "10 nil", string(le.HandleMessage(context.Background(), msg, &changed).Payload))
+
+	le.scripts.evict(luaCacheKey(changed.Subject, changed.Name))
+	assert.Equal(t, "10 nil", string(le.HandleMessage(context.Background(), msg, &changed).Payload))
+}
+
+func newBenchLuaExecutor(b *testing.B) (*LuaExecutor, *script.Script) {
+	le, scr := newTestLuaExecutor(b, benchScript)
+	le.store.AddLibrary(context.Background(), []byte(benchLibrary), "helpers")
+
+	return le, scr
+}
+
+func BenchmarkLuaExecutorWarm(b *testing.B) {
+	le, scr := newBenchLuaExecutor(b)
+	msg := &Message{Subject: "bench", Payload: []byte("hello")}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res := le.HandleMessage(context.Background(), msg, scr)
+		if res.Error != "" {
+			b.Fatal(res.Error)
+		}
+	}
+}
+
+// Evicting the script before each message compiles it and initializes a new state every time, like every
+// message did before the cache
+func BenchmarkLuaExecutorCold(b *testing.B) {
+	le, scr := newBenchLuaExecutor(b)
+	msg := &Message{Subject: "bench", Payload: []byte("hello")}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		le.scripts.evict(luaCacheKey(scr.Subject, scr.Name))
+		res := le.HandleMessage(context.Background(), msg, scr)
+		if res.Error != "" {
+			b.Fatal(res.Error)
+		}
+	}
+}
+
+func TestLuaExecutorHTTPStatus(t *testing.T) {
+	le, scr := newTestLuaExecutor(t, `--* subject: status
+--* name: status
+--* delivery: queue
+function OnMessage(subject, payload)
+  if payload == "denied" then
+    return "unauthorized", 401
+  end
+
+  return "ok"
+end
+`)
+
+	res := le.HandleMessage(context.Background(), &Message{Subject: "status", Payload: []byte("denied")}, scr)
+	assert.Equal(t, 401, res.Code)
+	assert.True(t, res.HTTPStatus)
+
+	res = le.HandleMessage(context.Background(), &Message{Subject: "status"}, scr)
+	assert.Equal(t, 0, res.Code)
+	assert.False(t, res.HTTPStatus)
+}
+
+func TestLuaExecutorHeaders(t *testing.T) {
+	le, scr := newTestLuaExecutor(t, `--* subject: headers
+--* name: headers
+--* delivery: queue
+function OnMessage(subject, payload, headers)
+  return headers["X-Tenant-Id"], 200, { ["X-Correlation-Id"] = headers["X-Correlation-Id"] }
+end
+`)
+
+	// The headers of the NATS message are passed to the script, the ones it returns are the headers of its result
+	header := nats.Header{"X-Tenant-Id": []string{"acme"}, "X-Correlation-Id": []string{"42"}}
+	res := le.HandleMessage(context.Background(), ParseMessage("headers", []byte("hello"), header), scr)
+	assert.Equal(t, "", res.Error)
+	assert.Equal(t, "acme", string(res.Payload))
+	assert.Equal(t, map[string]string{"X-Correlation-Id": "42"}, res.Headers)
+}
+
+func TestLuaExecutorSchedule(t *testing.T) {
+	le, scr := newTestLuaExecutor(t, `--* subject: tick
+--* name: tick
+--* delivery: queue
+function OnMessage(subject, payload)
+  return "message"
+end
+
+function OnSchedule(subject, payload)
+  return "schedule"
+end
+`)
+
+	// A client can't pass its message as a scheduled run
+	msg := ParseMessage("tick", []byte(`{"payload":"eA==","scheduled":true}`), nil)
+	assert.False(t, msg.Scheduled)
+	res := le.HandleMessage(context.Background(), msg, scr)
+	assert.Equal(t, "message", string(res.Payload))
+
+	msg.Scheduled = true
+	res = le.HandleMessage(context.Background(), msg, scr)
+	assert.Equal(t, "schedule", string(res.Payload))
+}
+
+func TestLuaExecutorTimeout(t *testing.T) {
+	le, scr := newTestLuaExecutor(t, `--* subject: slow
+--* name: slow
+--* delivery: queue
+--* timeout: 100ms
+function OnMessage(subject, payload)
+  while true do end
+end
+`)
+
+	start := time.Now()
+	res := le.HandleMessage(context.Background(), &Message{Subject: "slow"}, scr)
+	assert.Contains(t, res.Error, "context deadline exceeded")
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestLuaExecutorWorkdir(t *testing.T) {
+	le, scr := newTestLuaExecutor(t, `--* subject: files
+--* name: files
+--* delivery: queue
+--* workdir: persistent
+local lfs = require("lfs")
+
+function OnMessage(subject, payload)
+  local count = 0
+  local f = io.open("count", "r")
+  if f then
+    count = tonumber(f:read("*a"))
+    f:close()
+  end
+
+  f = io.open("count", "w")
+  f:write(tostring(count + 1))
+  f:close()
+
+  return lfs.currentdir() .. " " .. tostring(count + 1)
+end
+`)
+	msg := &Message{Subject: "files"}
+	cwd, err := os.Getwd()
+	assert.Nil(t, err)
+
+	// The persistent directory keeps the files between the runs
+	dir := filepath.Join(le.dataDir, "files", "files")
+	assert.Equal(t, dir+" 1", string(le.HandleMessage(context.Background(), msg, scr).Payload))
+	assert.Equal(t, dir+" 2", string(le.HandleMessage(context.Background(), msg, scr).Payload))
+
+	// Temporary directories start empty
+	scr.Workdir = ""
+	res := le.HandleMessage(context.Background(), msg, scr)
+	assert.True(t, strings.HasSuffix(string(res.Payload), " 1"))
+	assert.NotContains(t, string(res.Payload), dir)
+
+	after, err := os.Getwd()
+	assert.Nil(t, err)
+	assert.Equal(t, cwd, after)
+}
+
+func TestScriptCapabilities(t *testing.T) {
+	assert.Nil(t, scriptCapabilities(nil, nil))
+	assert.Nil(t, scriptCapabilities([]string{LUA_CAPABILITY_ALL}, nil))
+	assert.Equal(t, "http,json", scriptCapabilities(nil, []string{"json", "http"}).String())
+	assert.Equal(t, "http,nats", scriptCapabilities([]string{"http", "nats"}, nil).String())
+
+	// Scripts can't ask for more than what the server allows
+	assert.Equal(t, "http", scriptCapabilities([]string{"http", "nats"}, []string{"http", "os"}).String())
+}
+
+func TestLuaExecutorCapabilities(t *testing.T) {
+	le, scr := newTestLuaExecutor(t, `--* subject: caps
+--* name: caps
+--* delivery: queue
+--* capabilities: json
+local json = require("json")
+
+function OnMessage(subject, payload)
+  if payload == "http" then
+    require("http")
+  end
+
+  return json.encode({io = io == nil, execute = os.execute == nil, time = os.time() > 0, dofile = dofile == nil})
+end
+`)
+
+	res := le.HandleMessage(context.Background(), &Message{Subject: "caps"}, scr)
+	assert.Equal(t, "", res.Error)
+	assert.JSONEq(t, `{"io": true, "execute": true, "time": true, "dofile": true}`, string(res.Payload))
+
+	res = le.HandleMessage(context.Background(), &Message{Subject: "caps", Payload: []byte("http")}, scr)
+	assert.Contains(t, res.Error, "module 'http' is not allowed by the capabilities of the script")
+}
+
+func TestLuaExecutorLimits(t *testing.T) {
+	le, scr := newTestLuaExecutor(t, `--* subject: limits
+--* name: limits
+--* delivery: queue
+function OnMessage(subject, payload)
+  if payload == "loop" then
+    while true do end
+  elseif payload == "memory" then
+    local t = {}
+    for i = 1, 1000000 do
+      t[i] = string.rep("x", 100) .. i
+    end
+  elseif payload == "recursion" then
+    local function f(n) return f(n + 1) + 1 end
+    f(1)
+  end
+
+  return "ok"
+end
+`)
+	scr.Limits = script.Limits{CallStack: 64, Instructions: 1000000, Memory: 4 << 20}
+
+	for payload, limit := range map[string]string{
+		"loop":      LIMIT_INSTRUCTIONS,
+		"memory":    LIMIT_MEMORY,
+		"recursion": LIMIT_CALL_STACK,
+	} {
+		res := le.HandleMessage(context.Background(), &Message{Subject: "limits", Payload: []byte(payload)}, scr)
+		assert.Equal(t, (&LimitExceededError{Limit: limit}).Error(), res.Error, payload)
+	}
+
+	// The states stopped by a limit aren't reused
+	res := le.HandleMessage(context.Background(), &Message{Subject: "limits"}, scr)
+	assert.Equal(t, "", res.Error)
+	assert.Equal(t, "ok", string(res.Payload))
+}
+
+// The modules written in Go wait on the context of the state, from the goroutine running it or from their own ones,
+// these aren't instructions of the script
+func TestLuaBudgetModules(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	L.PreloadModule("wait", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"wait": func(L *lua.LState) int {
+				ctx := L.Context()
+				done := make(chan struct{})
+				go func() {
+					for i := 0; i < 1000; i++ {
+						ctx.Done()
+					}
+					close(done)
+				}()
+				for i := 0; i < 1000; i++ {
+					ctx.Done()
+				}
+				<-done
+
+				return 0
+			},
+		}))
+		return 1
+	})
+	uncountedModules(L)
+
+	ctx := newLuaBudget(context.Background(), script.Limits{Instructions: 500})
+	attachBudget(ctx, L)
+	L.SetContext(ctx)
+
+	err := L.DoString(`local wait = require("wait")
+for i = 1, 10 do
+  wait.wait()
+end`)
+	assert.Nil(t, err)
+	assert.Less(t, ctx.(*luaBudget).instructions.Load(), int64(500))
+
+	// The script itself is still counted
+	err = L.DoString(`while true do end`)
+	assert.NotNil(t, err)
+	assert.Equal(t, &LimitExceededError{Limit: LIMIT_INSTRUCTIONS}, limitError(ctx, err.Error()))
+}
+
+func TestLuaExecutorLibraries(t *testing.T) {
+	le, scr := newTestLuaExecutor(t, `--* subject: libs
+--* name: libs
+--* delivery: queue
+--* require: greet
+local greet = require("greet")
+
+function OnMessage(subject, payload)
+  if payload == "cycle" then
+    require("ping")
+  elseif payload == "error" then
+    greet.fail()
+  elseif payload == "script error" then
+    error("failed")
+  elseif payload == "global" then
+    return hello(payload)
+  elseif payload == "lazy" then
+    return require("lazy").Lazy .. " " .. tostring(Lazy)
+  end
+
+  return greet.hello(payload) .. " " .. tostring(Prefix)
+end
+`)
+	ctx := context.Background()
+	le.store.AddLibrary(ctx, []byte(`local format = require("format")
+
+Prefix = "hello"
+
+function hello(name)
+  return format.join(Prefix, name)
+end
+
+function fail()
+  error("failed")
+end
+`), "greet")
+	le.store.AddLibrary(ctx, []byte("return {join = function(a, b) return a .. \", \" .. b end}"), "format")
+	le.store.AddLibrary(ctx, []byte(`Lazy = "lazy"`), "lazy")
+	le.store.AddLibrary(ctx, []byte(`require("pong")`), "ping")
+	le.store.AddLibrary(ctx, []byte(`require("ping")`), "pong")
+
+	// The libraries it requires come from the store, the globals of a library of the header that doesn't return
+	// a module are also globals of the script
+	res := le.HandleMessage(ctx, &Message{Subject: "libs", Payload: []byte("world")}, scr)
+	assert.Equal(t, "", res.Error)
+	assert.Equal(t, "hello, world hello", string(res.Payload))
+
+	res = le.HandleMessage(ctx, &Message{Subject: "libs", Payload: []byte("global")}, scr)
+	assert.Equal(t, "hello, global", string(res.Payload))
+
+	// The globals of the other libraries stay in their module
+	res = le.HandleMessage(ctx, &Message{Subject: "libs", Payload: []byte("lazy")}, scr)
+	assert.Equal(t, "", res.Error)
+	assert.Equal(t, "lazy nil", string(res.Payload))
+
+	res = le.HandleMessage(ctx, &Message{Subject: "libs", Payload: []byte("cycle")}, scr)
+	assert.Contains(t, res.Error, "cyclic require of library 'ping': ping -> pong -> ping")
+
+	// The errors give the line in the library or the script
+	res = le.HandleMessage(ctx, &Message{Subject: "libs", Payload: []byte("error")}, scr)
+	assert.Contains(t, res.Error, "greet:10: failed")
+
+	// The headers aren't part of the content of the script
+	res = le.HandleMessage(ctx, &Message{Subject: "libs", Payload: []byte("script error")}, scr)
+	assert.Contains(t, res.Error, "libs:9: failed")
+}
@@ -0,0 +1,171 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+// loadLibraries reads the libraries from the store by name, the ones that aren't found are left out
+func loadLibraries(ctx context.Context, store msgstore.ScriptStore, names []string) (map[string][]byte, error) {
+	libs := make(map[string][]byte)
+	for _, name := range names {
+		if _, found := libs[name]; found {
+			continue
+		}
+
+		contents, err := store.LoadLibrairies(ctx, []string{name})
+		if err != nil {
+			return nil, err
+		}
+		if len(contents) == 1 {
+			libs[name] = contents[0]
+		}
+	}
+
+	return libs, nil
+}
+
+// luaLibraries makes the libraries of the store available to a Lua state as modules. Each library runs in its
+// own environment, its globals end up in its module unless it returns one.
+type luaLibraries struct {
+	compiled *compiledScript
+	store    msgstore.ScriptStore
+	loading  []string               // Libraries being loaded, the last one is requiring the next
+	globals  map[string]*lua.LTable // Globals of the libraries that didn't return a module
+}
+
+// install registers the compiled libraries in package.preload and looks for the other ones in the store. It must be
+// called once the modules and the capabilities are set up, the modules written in Go take precedence.
+func (ll *luaLibraries) install(L *lua.LState) {
+	pkg, ok := L.GetGlobal(lua.LoadLibName).(*lua.LTable)
+	if !ok {
+		return
+	}
+	preload, _ := pkg.RawGetString("preload").(*lua.LTable)
+	loaders, _ := pkg.RawGetString("loaders").(*lua.LTable)
+	if preload == nil || loaders == nil {
+		return
+	}
+
+	for _, name := range ll.compiled.libraryNames() {
+		if preload.RawGetString(name) == lua.LNil {
+			preload.RawSetString(name, L.NewFunction(ll.loader(ll.compiled.library(name))))
+		}
+	}
+
+	// Right after the preload loader, before the Lua files
+	loaders.Insert(2, L.NewFunction(ll.search))
+
+	require := L.GetGlobal("require")
+	L.SetGlobal("require", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		for i, loading := range ll.loading {
+			if loading == name {
+				L.RaiseError("cyclic require of library '%s': %s", name, strings.Join(append(ll.loading[i:], name), " -> "))
+			}
+		}
+
+		L.Push(require)
+		L.Push(lua.LString(name))
+		L.Call(1, 1)
+		return 1
+	}))
+}
+
+// requireHeader requires the libraries of the require header before the script runs. The ones that don't return a
+// module also have their globals set as globals of the state, like when the libraries were prepended to the script.
+func (ll *luaLibraries) requireHeader(L *lua.LState) error {
+	for _, name := range ll.compiled.required {
+		// The libraries missing from the store only fail when the script requires them
+		if ll.compiled.library(name) == nil {
+			continue
+		}
+
+		err := L.CallByParam(lua.P{
+			Fn:      L.GetGlobal("require"),
+			NRet:    0,
+			Protect: true,
+		}, lua.LString(name))
+		if err != nil {
+			return fmt.Errorf("failed to load library %s: %w", name, err)
+		}
+
+		if env, found := ll.globals[name]; found {
+			env.ForEach(func(k, v lua.LValue) {
+				L.G.Global.RawSet(k, v)
+			})
+		}
+	}
+
+	return nil
+}
+
+// search is the loader of the libraries that weren't compiled with the script, it reads them from the store
+func (ll *luaLibraries) search(L *lua.LState) int {
+	name := L.CheckString(1)
+
+	proto := ll.compiled.library(name)
+	if proto == nil {
+		ctx := L.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		libs, err := loadLibraries(ctx, ll.store, []string{name})
+		if err != nil {
+			L.Push(lua.LString(fmt.Sprintf("no library '%s' in the store: %s", name, err)))
+			return 1
+		}
+		source, found := libs[name]
+		if !found {
+			L.Push(lua.LString(fmt.Sprintf("no library '%s' in the store", name)))
+			return 1
+		}
+
+		proto, err = compileLua(name, source)
+		if err != nil {
+			L.RaiseError("failed to compile library %s: %s", name, err)
+		}
+		ll.compiled.addLibrary(name, source, proto)
+	}
+
+	L.Push(L.NewFunction(ll.loader(proto)))
+	return 1
+}
+
+// loader returns the function require calls to run the library and get its module
+func (ll *luaLibraries) loader(proto *lua.FunctionProto) lua.LGFunction {
+	return func(L *lua.LState) int {
+		name := L.CheckString(1)
+		ll.loading = append(ll.loading, name)
+		defer func() { ll.loading = ll.loading[:len(ll.loading)-1] }()
+
+		// The library reads the globals of the state but keeps its own
+		env := L.NewTable()
+		meta := L.NewTable()
+		meta.RawSetString("__index", L.G.Global)
+		L.SetMetatable(env, meta)
+
+		fn := L.NewFunctionFromProto(proto)
+		fn.Env = env
+		L.Push(fn)
+		L.Push(lua.LString(name))
+		L.Call(1, 1)
+
+		if L.Get(-1) == lua.LNil {
+			L.Pop(1)
+			L.Push(env)
+
+			if ll.globals == nil {
+				ll.globals = make(map[string]*lua.LTable)
+			}
+			ll.globals[name] = env
+		}
+		return 1
+	}
+}
@@ -0,0 +1,276 @@
+package executor
+
+import (
+	"context"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/numkem/msgscript/script"
+)
+
+// How many instructions run before the memory used by a script is first estimated. The next estimates are spaced
+// by how many values the previous one went through so they don't slow down the scripts holding a lot of them.
+const LUA_MEMORY_CHECK_INTERVAL = 10000
+
+// luaStateOptions returns the options of a Lua state bounding its call stack and registry
+func luaStateOptions(limits script.Limits) lua.Options {
+	opts := lua.Options{
+		CallStackSize: limits.CallStack,
+		RegistrySize:  lua.RegistrySize,
+	}
+
+	// The registry starts at its default size and grows up to the limit
+	if limits.Registry > 0 {
+		size := max(limits.Registry, 128)
+		opts.RegistrySize = min(lua.RegistrySize, size)
+		opts.RegistryMaxSize = size
+	}
+
+	return opts
+}
+
+// luaBudget is the context of a Lua state counting the instructions it runs, since the state checks its context
+// before running each of them. It is cancelled once the script ran too many instructions or used too much memory.
+//
+// gopher-lua doesn't have hooks, so the count is approximate: the modules written in Go also check the context of
+// the state, only the checks made while a function of their module table runs are left out (see uncountedModules).
+// The checks made by the methods of the values they return, or by the goroutines they leave behind, are counted.
+type luaBudget struct {
+	context.Context
+	L            *lua.LState
+	limits       script.Limits
+	goroutine    uint64
+	modules      atomic.Int32 // How many functions of the modules are running
+	instructions atomic.Int64
+	nextCheck    atomic.Int64
+	exceeded     atomic.Pointer[LimitExceededError]
+	done         chan struct{}
+}
+
+// newLuaBudget returns the context enforcing the limits, or the context itself when there aren't any to count.
+// It must be created by the goroutine running the state.
+func newLuaBudget(ctx context.Context, limits script.Limits) context.Context {
+	if limits.Instructions <= 0 && limits.Memory <= 0 {
+		return ctx
+	}
+
+	b := &luaBudget{
+		Context:   ctx,
+		limits:    limits,
+		goroutine: goroutineID(),
+		done:      make(chan struct{}),
+	}
+	b.nextCheck.Store(LUA_MEMORY_CHECK_INTERVAL)
+
+	return b
+}
+
+// attachBudget gives the state whose memory is estimated to the budget
+func attachBudget(ctx context.Context, L *lua.LState) {
+	if b, ok := ctx.(*luaBudget); ok {
+		b.L = L
+	}
+}
+
+func (b *luaBudget) exceed(limit string) {
+	if b.exceeded.CompareAndSwap(nil, &LimitExceededError{Limit: limit}) {
+		close(b.done)
+	}
+}
+
+func (b *luaBudget) Done() <-chan struct{} {
+	if b.exceeded.Load() != nil {
+		return b.done
+	}
+	if b.modules.Load() > 0 {
+		return b.Context.Done()
+	}
+
+	n := b.instructions.Add(1)
+	if b.limits.Instructions > 0 && n > b.limits.Instructions {
+		b.exceed(LIMIT_INSTRUCTIONS)
+		return b.done
+	}
+
+	// The modules can also wait on the context from their own goroutines, only the one running the state
+	// can go through its values. The goroutine is only looked up once an estimate is due, it's too slow to
+	// be done for each instruction.
+	if b.limits.Memory > 0 && b.L != nil && n >= b.nextCheck.Load() && goroutineID() == b.goroutine {
+		size, visited := luaMemory(b.L, b.limits.Memory)
+		b.nextCheck.Store(n + max(LUA_MEMORY_CHECK_INTERVAL, 100*int64(visited)))
+
+		if size > b.limits.Memory {
+			b.exceed(LIMIT_MEMORY)
+			return b.done
+		}
+	}
+
+	return b.Context.Done()
+}
+
+func (b *luaBudget) Err() error {
+	if e := b.exceeded.Load(); e != nil {
+		return e
+	}
+
+	return b.Context.Err()
+}
+
+// limitError returns the limit the script exceeded when it's why it failed
+func limitError(ctx context.Context, err string) error {
+	if b, ok := ctx.(*luaBudget); ok {
+		if e := b.exceeded.Load(); e != nil {
+			return e
+		}
+	}
+
+	switch {
+	case strings.Contains(err, "stack overflow"):
+		return &LimitExceededError{Limit: LIMIT_CALL_STACK}
+	case strings.Contains(err, "registry overflow"):
+		return &LimitExceededError{Limit: LIMIT_REGISTRY}
+	}
+
+	return nil
+}
+
+// uncountedModules wraps the functions of the modules preloaded in the state so the checks of the context they make
+// while they run don't count as instructions of the script. It must be called once the modules are preloaded.
+func uncountedModules(L *lua.LState) {
+	pkg, ok := L.GetGlobal(lua.LoadLibName).(*lua.LTable)
+	if !ok {
+		return
+	}
+	preload, ok := pkg.RawGetString("preload").(*lua.LTable)
+	if !ok {
+		return
+	}
+
+	loaders := make(map[lua.LValue]*lua.LFunction)
+	preload.ForEach(func(name, v lua.LValue) {
+		if fn, ok := v.(*lua.LFunction); ok && fn.IsG {
+			loaders[name] = fn
+		}
+	})
+
+	for name, loader := range loaders {
+		preload.RawSet(name, L.NewFunction(func(L *lua.LState) int {
+			n := loader.GFunction(L)
+			if mod, ok := L.Get(-1).(*lua.LTable); ok && n > 0 {
+				mod.ForEach(func(k, v lua.LValue) {
+					if fn, ok := v.(*lua.LFunction); ok && fn.IsG {
+						mod.RawSet(k, L.NewFunction(uncounted(fn.GFunction)))
+					}
+				})
+			}
+			return n
+		}))
+	}
+}
+
+// uncounted runs the function without counting the checks of the context as instructions
+func uncounted(fn lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		b, ok := L.Context().(*luaBudget)
+		if !ok {
+			return fn(L)
+		}
+
+		b.modules.Add(1)
+		defer b.modules.Add(-1)
+		return fn(L)
+	}
+}
+
+// goroutineID returns the ID of the running goroutine, read from its stack trace
+func goroutineID() uint64 {
+	var buf [64]byte
+	s := strings.TrimPrefix(string(buf[:runtime.Stack(buf[:], false)]), "goroutine ")
+	id, _, _ := strings.Cut(s, " ")
+	n, _ := strconv.ParseUint(id, 10, 64)
+
+	return n
+}
+
+// luaMemoryWalk adds up the estimated size of the values it goes through
+type luaMemoryWalk struct {
+	seen    map[lua.LValue]bool
+	size    int64
+	limit   int64
+	visited int
+}
+
+// luaMemory estimates the memory used by the values the state can reach: its globals, its registry and the
+// variables of the running functions. It stops once over the limit and also returns how many values it went through.
+func luaMemory(L *lua.LState, limit int64) (int64, int) {
+	w := &luaMemoryWalk{seen: make(map[lua.LValue]bool), limit: limit}
+	w.value(L.G.Global)
+	w.value(L.G.Registry)
+
+	for level := 0; ; level++ {
+		dbg, ok := L.GetStack(level)
+		if !ok {
+			break
+		}
+
+		for i := 1; ; i++ {
+			name, v := L.GetLocal(dbg, i)
+			if name == "" {
+				break
+			}
+			w.value(v)
+		}
+	}
+
+	return w.size, w.visited
+}
+
+func (w *luaMemoryWalk) value(v lua.LValue) {
+	if v == nil || w.size > w.limit {
+		return
+	}
+	w.visited++
+
+	switch v := v.(type) {
+	case lua.LString:
+		w.size += 16 + int64(len(v))
+	case *lua.LTable:
+		if w.seen[v] {
+			return
+		}
+		w.seen[v] = true
+
+		w.size += 64
+		v.ForEach(func(key, value lua.LValue) {
+			w.size += 32
+			w.value(key)
+			w.value(value)
+		})
+		w.value(v.Metatable)
+	case *lua.LFunction:
+		if w.seen[v] {
+			return
+		}
+		w.seen[v] = true
+
+		w.size += 64
+		w.value(v.Env)
+		for _, uv := range v.Upvalues {
+			w.value(uv.Value())
+		}
+	case *lua.LUserData:
+		if w.seen[v] {
+			return
+		}
+		w.seen[v] = true
+
+		w.size += 64
+		w.value(v.Metatable)
+	default:
+		w.size += 16
+	}
+}
@@ -0,0 +1,164 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/numkem/msgscript/script"
+)
+
+// luaWorkdir is the working directory of a Lua state. The functions of the io, os and lfs modules taking a path
+// resolve the relative ones against it instead of the working directory of the server, so scripts running at the
+// same time don't share it.
+type luaWorkdir struct {
+	dir string
+}
+
+// resolve returns the path relative to the working directory, absolute paths are returned as-is
+func (w *luaWorkdir) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(w.dir, path)
+}
+
+// shellCommand runs the command from the working directory
+func (w *luaWorkdir) shellCommand(cmd string) string {
+	return "cd '" + strings.ReplaceAll(w.dir, "'", `'\''`) + "' && " + cmd
+}
+
+// wrap replaces the function of the table by one changing its string arguments at the given positions
+// before calling it
+func (w *luaWorkdir) wrap(L *lua.LState, t *lua.LTable, name string, change func(string) string, args ...int) {
+	orig := t.RawGetString(name)
+	if orig.Type() != lua.LTFunction {
+		return
+	}
+
+	t.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+		for _, i := range args {
+			if s, ok := L.Get(i).(lua.LString); ok {
+				L.Replace(i, lua.LString(change(string(s))))
+			}
+		}
+
+		top := L.GetTop()
+		L.Push(orig)
+		for i := 1; i <= top; i++ {
+			L.Push(L.Get(i))
+		}
+		L.Call(top, lua.MultRet)
+
+		return L.GetTop() - top
+	}))
+}
+
+// install makes the functions of the state use the working directory. It must be called once the standard library
+// and the lfs module are loaded.
+func (w *luaWorkdir) install(L *lua.LState) {
+	if io, ok := L.GetGlobal("io").(*lua.LTable); ok {
+		w.wrap(L, io, "open", w.resolve, 1)
+		w.wrap(L, io, "lines", w.resolve, 1)
+		w.wrap(L, io, "input", w.resolve, 1)
+		w.wrap(L, io, "output", w.resolve, 1)
+		w.wrap(L, io, "popen", w.shellCommand, 1)
+	}
+
+	if os, ok := L.GetGlobal("os").(*lua.LTable); ok {
+		w.wrap(L, os, "remove", w.resolve, 1)
+		w.wrap(L, os, "rename", w.resolve, 1, 2)
+		w.wrap(L, os, "execute", w.shellCommand, 1)
+	}
+
+	w.wrap(L, L.G.Global, "dofile", w.resolve, 1)
+	w.wrap(L, L.G.Global, "loadfile", w.resolve, 1)
+
+	// lfs is only loaded when the script requires it
+	preload, ok := L.GetField(L.GetGlobal("package"), "preload").(*lua.LTable)
+	if !ok {
+		return
+	}
+	loader, ok := preload.RawGetString("lfs").(*lua.LFunction)
+	if !ok {
+		return
+	}
+
+	preload.RawSetString("lfs", L.NewFunction(func(L *lua.LState) int {
+		L.Push(loader)
+		L.Call(0, 1)
+
+		mod, ok := L.Get(-1).(*lua.LTable)
+		if !ok {
+			return 1
+		}
+
+		for _, name := range []string{"attributes", "dir", "lock_dir", "mkdir", "rmdir", "symlinkattributes", "touch"} {
+			w.wrap(L, mod, name, w.resolve, 1)
+		}
+		w.wrap(L, mod, "link", w.resolve, 1, 2)
+		mod.RawSetString("currentdir", L.NewFunction(w.luaCurrentdir))
+		mod.RawSetString("chdir", L.NewFunction(w.luaChdir))
+
+		return 1
+	}))
+}
+
+func (w *luaWorkdir) luaCurrentdir(L *lua.LState) int {
+	L.Push(lua.LString(w.dir))
+	return 1
+}
+
+// luaChdir changes the working directory of the state only
+func (w *luaWorkdir) luaChdir(L *lua.LState) int {
+	dir := w.resolve(L.CheckString(1))
+
+	stat, err := os.Stat(dir)
+	if err == nil && !stat.IsDir() {
+		err = fmt.Errorf("%s is not a directory", dir)
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	w.dir = dir
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// pathElement makes the subject or name of a script usable as a single element of a path
+func pathElement(s string) string {
+	s = strings.NewReplacer("/", "_", `\`, "_").Replace(s)
+	if s == "" || s == "." || s == ".." {
+		s = "_" + s
+	}
+
+	return s
+}
+
+// scriptWorkdir returns the working directory of a run of the script. Temporary directories have to be removed
+// with the returned function.
+func scriptWorkdir(dataDir string, scr *script.Script) (string, func(), error) {
+	if scr.Workdir == script.WORKDIR_PERSISTENT {
+		dir := filepath.Join(dataDir, pathElement(scr.Subject), pathElement(scr.Name))
+		err := os.MkdirAll(dir, 0o755)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to create data directory %s: %w", dir, err)
+		}
+
+		return dir, func() {}, nil
+	}
+
+	dir, err := os.MkdirTemp(os.TempDir(), "msgscript-lua-*s")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }, nil
+}
@@ -22,4 +22,8 @@ func (e *noPodmanExecutor) HandleMessage(ctx context.Context, msg *Message, scr
 	return ScriptResultWithError(fmt.Errorf("msgscript wasn't built with podman support"))
 }
 
+func (e *noPodmanExecutor) HandleBatch(ctx context.Context, msgs []*Message, scr *script.Script) []*ScriptResult {
+	return batchResultsWithError(len(msgs), "msgscript wasn't built with podman support")
+}
+
 func (e *noPodmanExecutor) Stop() {}
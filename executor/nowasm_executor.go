@@ -25,4 +25,8 @@ func (e *noWasmExecutor) HandleMessage(ctx context.Context, msg *Message, scr *s
 	return ScriptResultWithError(fmt.Errorf("msgscript wasn't built with wasm support"))
 }
 
+func (e *noWasmExecutor) HandleBatch(ctx context.Context, msgs []*Message, scr *script.Script) []*ScriptResult {
+	return batchResultsWithError(len(msgs), "msgscript wasn't built with wasm support")
+}
+
 func (e *noWasmExecutor) Stop() {}
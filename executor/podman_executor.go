@@ -81,6 +81,10 @@ func (pe *PodmanExecutor) HandleMessage(ctx context.Context, msg *Message, scr *
 
 	fields["name"] = scr.Name
 
+	// The container is killed once its timeout or the caller's deadline is reached
+	ctx, cancel := withScriptTimeout(ctx, scr, 0)
+	defer cancel()
+
 	_, parseSpan := podmanTracer.Start(ctx, "podman.parse_script")
 	scr, err := scriptLib.ReadString(string(scr.Content))
 	if err != nil {
@@ -162,7 +166,7 @@ func (pe *PodmanExecutor) executeInContainer(ctx context.Context, fields log.Fie
 	spec := specgen.NewSpecGenerator(cfg.Image, false)
 	spec.Command = cfg.Command
 	spec.Name = containerName
-	spec.Env = map[string]string{"SUBJECT": msg.Subject, "URL": msg.URL, "PAYLOAD": string(msg.Payload), "METHOD": msg.Method}
+	spec.Env = map[string]string{"SUBJECT": msg.Subject, "URL": msg.URL, "PAYLOAD": string(msg.Payload), "METHOD": msg.Method, "HEADERS": headersJSON(msg.Headers)}
 	spec.Mounts = cfg.Mounts
 	spec.User = cfg.User
 	spec.Groups = cfg.Groups
@@ -283,6 +287,14 @@ func (pe *PodmanExecutor) executeInContainer(ctx context.Context, fields log.Fie
 	startSpan.SetStatus(codes.Ok, "")
 	startSpan.End()
 
+	stopKill := context.AfterFunc(ctx, func() {
+		log.WithFields(fields).Warn("deadline reached, killing container")
+		containers.Kill(pe.ConnText, container.ID, &containers.KillOptions{
+			Signal: stringPtr("SIGKILL"),
+		})
+	})
+	defer stopKill()
+
 	// Wait for container to finish
 	_, waitSpan := podmanTracer.Start(ctx, "podman.wait_container",
 		trace.WithAttributes(
@@ -298,6 +310,13 @@ func (pe *PodmanExecutor) executeInContainer(ctx context.Context, fields log.Fie
 		span.SetStatus(codes.Error, "Container wait failed")
 		return nil, fmt.Errorf("Container exited with error: %w", err)
 	}
+	if ctx.Err() != nil {
+		waitSpan.SetStatus(codes.Error, "Container killed")
+		waitSpan.End()
+		span.SetStatus(codes.Error, "Container killed")
+		pe.containers.Delete(containerName)
+		return nil, fmt.Errorf("container killed: %w", ctx.Err())
+	}
 	log.WithField("containerName", containerName).Infof("container exited with code: %d", exitCode)
 	waitSpan.SetAttributes(attribute.Int("container.exit_code", int(exitCode)))
 	if exitCode != 0 {
@@ -368,6 +387,11 @@ func (pe *PodmanExecutor) executeInContainer(ctx context.Context, fields log.Fie
 	return result, nil
 }
 
+// HandleBatch runs the container once with the JSON array of the messages as payload
+func (pe *PodmanExecutor) HandleBatch(ctx context.Context, msgs []*Message, scr *script.Script) []*ScriptResult {
+	return handleBatchAsJSON(ctx, pe, msgs, scr)
+}
+
 func (pe *PodmanExecutor) Stop() {
 	// Go through each running container and kill them
 	pe.containers.Range(func(key, value any) bool {
@@ -0,0 +1,34 @@
+//go:build podman
+
+package executor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/numkem/msgscript/script"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+func TestPodmanExecutorTimeout(t *testing.T) {
+	store, err := msgstore.NewDevStore("")
+	assert.Nil(t, err)
+	pe, err := NewPodmanExecutor(context.Background(), store)
+	if err != nil {
+		t.Skipf("podman isn't available: %v", err)
+	}
+	defer pe.Stop()
+
+	// The container would sleep for 10 minutes without being killed
+	scr := &script.Script{
+		Subject: "slow",
+		Name:    "slow",
+		Content: []byte(`{"image": "docker.io/library/alpine", "command": ["sleep", "600"]}`),
+		Timeout: time.Second,
+	}
+	res := pe.HandleMessage(context.Background(), &Message{Subject: "slow"}, scr)
+	assert.Contains(t, res.Error, "container killed: context deadline exceeded")
+}
@@ -0,0 +1,75 @@
+package executor
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/numkem/msgscript/script"
+)
+
+const (
+	DEFAULT_DEAD_LETTER_PREFIX = "msgscript.dlq"
+	DEAD_LETTER_STREAM_NAME    = "MSGSCRIPT_DLQ"
+	MAX_RETRY_BACKOFF          = 5 * time.Minute
+)
+
+// DeadLetter is published to the dead-letter subject once a script failed all of its attempts
+type DeadLetter struct {
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Message  *Message  `json:"message"`
+	Name     string    `json:"name"`
+	Subject  string    `json:"subject"`
+	Time     time.Time `json:"time"`
+}
+
+// DeadLetterSubject returns the subject the dead letters of the given subject are published to
+func DeadLetterSubject(prefix, subject string) string {
+	return prefix + "." + subject
+}
+
+// retryBackoff returns the delay before the given attempt, doubling after each one
+func retryBackoff(backoff time.Duration, attempt int) time.Duration {
+	delay := backoff
+	for i := 1; i < attempt && delay < MAX_RETRY_BACKOFF; i++ {
+		delay *= 2
+	}
+
+	return min(delay, MAX_RETRY_BACKOFF)
+}
+
+// HandleMessageWithRetries runs the script with the executor, running it again up to the number of
+// retries defined by the script while it fails. It returns the last result along with the number of attempts.
+func HandleMessageWithRetries(ctx context.Context, exec Executor, msg *Message, scr *script.Script) (*ScriptResult, int) {
+	attempt := 1
+	for {
+		res := exec.HandleMessage(ctx, msg, scr)
+		if res == nil {
+			res = &ScriptResult{Error: "executor returned no result"}
+		}
+
+		// Not getting the lock means another instance is running the script
+		if res.Error == "" || res.Error == (&LockNotAcquiredError{}).Error() || attempt > scr.Retries {
+			return res, attempt
+		}
+
+		// Nobody is waiting for the result anymore
+		if ctx.Err() != nil {
+			return res, attempt
+		}
+
+		delay := retryBackoff(scr.RetryBackoff, attempt)
+		log.WithField("subject", msg.Subject).WithField("name", scr.Name).WithField("attempt", attempt).
+			Debugf("script failed, retrying in %s: %s", delay, res.Error)
+
+		select {
+		case <-ctx.Done():
+			return res, attempt
+		case <-time.After(delay):
+		}
+
+		attempt++
+	}
+}
@@ -54,6 +54,10 @@ func (we *WasmExecutor) HandleMessage(ctx context.Context, msg *Message, scr *sc
 
 	res := new(ScriptResult)
 
+	// The module is interrupted once its timeout or the caller's deadline is reached
+	ctx, cancel := withScriptTimeout(ctx, scr, 0)
+	defer cancel()
+
 	fields := log.Fields{
 		"subject":  scr.Subject,
 		"path":     scr.Name,
@@ -74,7 +78,7 @@ func (we *WasmExecutor) HandleMessage(ctx context.Context, msg *Message, scr *sc
 		readSpan.End()
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "Failed to read WASM module")
-		res.Error = fmt.Sprintf("failed to read wasm module file %s: %w", scr.Content, err)
+		res.Error = fmt.Sprintf("failed to read wasm module file %s: %v", scr.Content, err)
 		return res
 	}
 	readSpan.SetAttributes(attribute.Int("wasm.module_size", len(wasmBytes)))
@@ -116,7 +120,9 @@ func (we *WasmExecutor) HandleMessage(ctx context.Context, msg *Message, scr *sc
 
 	// Initialize WASM runtime
 	_, initSpan := wasmTracer.Start(ctx, "wasm.initialize_runtime")
-	engine := wasmtime.NewEngine()
+	cfg := wasmtime.NewConfig()
+	cfg.SetEpochInterruption(true)
+	engine := wasmtime.NewEngineWithConfig(cfg)
 	module, err := wasmtime.NewModule(engine, wasmBytes)
 	if err != nil {
 		initSpan.RecordError(err)
@@ -141,7 +147,7 @@ func (we *WasmExecutor) HandleMessage(ctx context.Context, msg *Message, scr *sc
 	wasiConfig := wasmtime.NewWasiConfig()
 	wasiConfig.SetStdoutFile(stdoutFile.Name())
 	wasiConfig.SetStderrFile(stderrFile.Name())
-	wasiConfig.SetEnv([]string{"SUBJECT", "PAYLOAD", "METHOD", "URL"}, []string{msg.Subject, string(msg.Payload), msg.Method, msg.URL})
+	wasiConfig.SetEnv([]string{"SUBJECT", "PAYLOAD", "METHOD", "URL", "HEADERS"}, []string{msg.Subject, string(msg.Payload), msg.Method, msg.URL, headersJSON(msg.Headers)})
 	span.SetAttributes(
 		attribute.String("wasm.env.subject", msg.Subject),
 		attribute.String("wasm.env.method", msg.Method),
@@ -150,6 +156,11 @@ func (we *WasmExecutor) HandleMessage(ctx context.Context, msg *Message, scr *sc
 
 	store := wasmtime.NewStore(engine)
 	store.SetWasi(wasiConfig)
+	store.SetEpochDeadline(1)
+
+	// Incrementing the epoch past the store's deadline traps the running module
+	stopInterrupt := context.AfterFunc(ctx, engine.IncrementEpoch)
+	defer stopInterrupt()
 
 	instance, err := linker.Instantiate(store, module)
 	if err != nil {
@@ -179,6 +190,14 @@ func (we *WasmExecutor) HandleMessage(ctx context.Context, msg *Message, scr *sc
 	}
 
 	_, err = wasmFunc.Call(store)
+	if err != nil && ctx.Err() != nil {
+		execSpan.RecordError(err)
+		execSpan.SetStatus(codes.Error, "WASM module interrupted")
+		execSpan.End()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "WASM module interrupted")
+		return ScriptResultWithError(fmt.Errorf("wasm module interrupted: %w", ctx.Err()))
+	}
 	if err != nil {
 		ec, ok := err.(*wasmtime.Error).ExitStatus()
 		execSpan.SetAttributes(attribute.Int("wasm.exit_code", int(ec)))
@@ -270,6 +289,11 @@ func readTempFile(f *os.File) ([]byte, error) {
 	return b, nil
 }
 
+// HandleBatch runs the module once with the JSON array of the messages as payload
+func (we *WasmExecutor) HandleBatch(ctx context.Context, msgs []*Message, scr *script.Script) []*ScriptResult {
+	return handleBatchAsJSON(ctx, we, msgs, scr)
+}
+
 func (we *WasmExecutor) Stop() {
 	we.cancelFunc()
 	log.Debug("WasmExecutor stopped")
@@ -0,0 +1,38 @@
+//go:build wasmtime
+
+package executor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go/v37"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/numkem/msgscript/script"
+	msgstore "github.com/numkem/msgscript/store"
+)
+
+func TestWasmExecutorTimeout(t *testing.T) {
+	// A module looping forever
+	wasm, err := wasmtime.Wat2Wasm(`(module
+  (memory (export "memory") 1)
+  (func (export "_start") (loop (br 0))))`)
+	assert.Nil(t, err)
+	modulePath := filepath.Join(t.TempDir(), "loop.wasm")
+	assert.Nil(t, os.WriteFile(modulePath, wasm, 0o644))
+
+	store, err := msgstore.NewDevStore("")
+	assert.Nil(t, err)
+	we := NewWasmExecutor(context.Background(), store, nil, nil)
+	defer we.Stop()
+
+	scr := &script.Script{Subject: "slow", Name: "slow", Content: []byte(modulePath), Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	res := we.HandleMessage(context.Background(), &Message{Subject: "slow"}, scr)
+	assert.Contains(t, res.Error, "wasm module interrupted: context deadline exceeded")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
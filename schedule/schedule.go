@@ -0,0 +1,245 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DESCRIPTOR_EVERY = "@every"
+	// Prevents looping forever on schedules that never match, like the 30th of February
+	MAX_SEARCH_YEARS = 5
+)
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type bounds struct {
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	minuteBounds = bounds{min: 0, max: 59}
+	hourBounds   = bounds{min: 0, max: 23}
+	domBounds    = bounds{min: 1, max: 31}
+	monthBounds  = bounds{min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// Both 0 and 7 are sunday
+	dowBounds = bounds{min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// Schedule returns the next time a job should run after the given time
+type Schedule interface {
+	Next(time.Time) time.Time
+}
+
+// Parse reads either a standard 5 fields cron expression (minute, hour, day of month, month, day of week),
+// one of the predefined descriptors (@hourly, @daily...) or an interval in the form of "@every 30s"
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if strings.HasPrefix(spec, DESCRIPTOR_EVERY) {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, DESCRIPTOR_EVERY)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval %s: %w", spec, err)
+		}
+		if interval < time.Second {
+			return nil, fmt.Errorf("invalid interval %s: must be at least 1s", spec)
+		}
+
+		return &everySchedule{interval: interval}, nil
+	}
+
+	if strings.HasPrefix(spec, "@") {
+		expr, found := descriptors[spec]
+		if !found {
+			return nil, fmt.Errorf("unknown descriptor %s", spec)
+		}
+		spec = expr
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %s: expected 5 fields, got %d", spec, len(fields))
+	}
+
+	s := new(cronSchedule)
+	var err error
+	for i, f := range []struct {
+		value  string
+		bounds bounds
+		bits   *uint64
+	}{
+		{fields[0], minuteBounds, &s.minute},
+		{fields[1], hourBounds, &s.hour},
+		{fields[2], domBounds, &s.dom},
+		{fields[3], monthBounds, &s.month},
+		{fields[4], dowBounds, &s.dow},
+	} {
+		*f.bits, err = parseField(f.value, f.bounds)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field %d of cron expression %s: %w", i+1, spec, err)
+		}
+	}
+
+	// Sunday can be written as 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	// When both are restricted, a day matching either of them is a match
+	s.domStar = fields[2] == "*"
+	s.dowStar = fields[4] == "*"
+
+	return s, nil
+}
+
+// parseField returns a bitset of the values allowed by a comma separated list of ranges
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %s", stepStr)
+			}
+		}
+
+		var start, end int
+		switch {
+		case rng == "*":
+			start, end = b.min, b.max
+		case strings.Contains(rng, "-"):
+			lo, hi, _ := strings.Cut(rng, "-")
+
+			var err error
+			start, err = parseValue(lo, b)
+			if err != nil {
+				return 0, err
+			}
+			end, err = parseValue(hi, b)
+			if err != nil {
+				return 0, err
+			}
+		default:
+			var err error
+			start, err = parseValue(rng, b)
+			if err != nil {
+				return 0, err
+			}
+
+			// "5/15" means every 15 starting at 5
+			end = start
+			if hasStep {
+				end = b.max
+			}
+		}
+
+		if start > end {
+			return 0, fmt.Errorf("invalid range %s", rng)
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+
+	return bits, nil
+}
+
+func parseValue(s string, b bounds) (int, error) {
+	if v, found := b.names[strings.ToLower(s)]; found {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %s", s)
+	}
+
+	if v < b.min || v > b.max {
+		return 0, fmt.Errorf("value %d out of range [%d, %d]", v, b.min, b.max)
+	}
+
+	return v, nil
+}
+
+type everySchedule struct {
+	interval time.Duration
+}
+
+// Next aligns the runs on the interval so every instance of the server agrees on the time of each run
+func (s *everySchedule) Next(t time.Time) time.Time {
+	return t.Truncate(s.interval).Add(s.interval)
+}
+
+type cronSchedule struct {
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool
+	dowStar bool
+}
+
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(MAX_SEARCH_YEARS, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+
+	return domMatch || dowMatch
+}
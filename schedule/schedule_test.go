@@ -0,0 +1,51 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCron(t *testing.T) {
+	from := time.Date(2024, time.January, 15, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"*/5 * * * *", time.Date(2024, time.January, 15, 10, 10, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2024, time.January, 15, 11, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2024, time.January, 16, 2, 30, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2024, time.January, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan,jul *", time.Date(2024, time.July, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, time.January, 21, 0, 0, 0, 0, time.UTC)},
+		// Either the 1st of the month or a friday
+		{"0 0 1 * 5", time.Date(2024, time.January, 19, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.January, 16, 0, 0, 0, 0, time.UTC)},
+		{"@every 30s", time.Date(2024, time.January, 15, 10, 8, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		s, err := Parse(test.spec)
+		if assert.Nil(t, err, test.spec) {
+			assert.Equal(t, test.expected, s.Next(from), test.spec)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"@fortnightly",
+		"@every 1ms",
+	} {
+		_, err := Parse(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
@@ -0,0 +1,59 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Limits bound the resources a Lua script can use on each run, 0 means no limit
+type Limits struct {
+	CallStack    int   `json:"call_stack"`
+	Instructions int64 `json:"instructions"`
+	Memory       int64 `json:"memory"`
+	Registry     int   `json:"registry"`
+}
+
+// Within returns the limits bounded by the ones of the server. The limits of the server are used
+// when they are lower or when the script doesn't set them.
+func (l Limits) Within(server Limits) Limits {
+	lower := func(scr, srv int64) int64 {
+		if scr <= 0 || (srv > 0 && srv < scr) {
+			return srv
+		}
+		return scr
+	}
+
+	return Limits{
+		CallStack:    int(lower(int64(l.CallStack), int64(server.CallStack))),
+		Instructions: lower(l.Instructions, server.Instructions),
+		Memory:       lower(l.Memory, server.Memory),
+		Registry:     int(lower(int64(l.Registry), int64(server.Registry))),
+	}
+}
+
+// ParseSize reads a size in bytes with an optional unit, either `k`, `m` or `g` (ex: `64m` or `64MB`)
+func ParseSize(spec string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(spec))
+	s = strings.TrimSuffix(s, "b")
+
+	var mult int64 = 1
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "g"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", spec)
+	}
+
+	return n * mult, nil
+}
@@ -0,0 +1,66 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimit is how many messages a script handles per period, with bursts of up to Burst messages
+type RateLimit struct {
+	Burst int           `json:"burst"`
+	Per   time.Duration `json:"per"`
+	Rate  int           `json:"rate"`
+}
+
+// Enabled tells if the rate limit was defined
+func (r RateLimit) Enabled() bool {
+	return r.Rate > 0 && r.Per > 0
+}
+
+// ParseRateLimit reads a rate limit like `10/s burst 20`. The period is either `s`, `m`, `h` or a duration
+// (ex: `10/5s`) and the burst defaults to the rate.
+func ParseRateLimit(spec string) (RateLimit, error) {
+	var rl RateLimit
+
+	fields := strings.Fields(spec)
+	if len(fields) != 1 && (len(fields) != 3 || fields[1] != "burst") {
+		return rl, fmt.Errorf("invalid rate limit %q, expected <rate>/<period> [burst <size>]", spec)
+	}
+
+	rate, period, found := strings.Cut(fields[0], "/")
+	if !found {
+		return rl, fmt.Errorf("invalid rate limit %q, missing the period", spec)
+	}
+
+	var err error
+	rl.Rate, err = strconv.Atoi(rate)
+	if err != nil || rl.Rate <= 0 {
+		return rl, fmt.Errorf("invalid rate %q", rate)
+	}
+
+	switch period {
+	case "s":
+		rl.Per = time.Second
+	case "m":
+		rl.Per = time.Minute
+	case "h":
+		rl.Per = time.Hour
+	default:
+		rl.Per, err = time.ParseDuration(period)
+		if err != nil || rl.Per <= 0 {
+			return rl, fmt.Errorf("invalid period %q", period)
+		}
+	}
+
+	rl.Burst = rl.Rate
+	if len(fields) == 3 {
+		rl.Burst, err = strconv.Atoi(fields[2])
+		if err != nil || rl.Burst <= 0 {
+			return rl, fmt.Errorf("invalid burst %q", fields[2])
+		}
+	}
+
+	return rl, nil
+}
@@ -9,6 +9,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -16,13 +17,79 @@ const (
 	LIBRARY_FOLDER_NAME = "libs"
 )
 
+// Delivery modes of a script
+const (
+	// Every instance of the server receives the message, only the one taking the lock runs the script
+	DELIVERY_BROADCAST = "broadcast"
+	// A single instance of the server receives the message through a NATS queue group
+	DELIVERY_QUEUE = "queue"
+	// A single instance of the server receives the message through a JetStream durable consumer
+	DELIVERY_STREAM = "stream"
+	// A single instance of the server runs the script on its schedule, the others skip the run
+	DELIVERY_SCHEDULE = "schedule"
+)
+
+// Where the results of a script are cached
+const (
+	// In the memory of each instance
+	CACHE_SCOPE_LOCAL = "local"
+	// In the store, shared by all the instances when using etcd
+	CACHE_SCOPE_SHARED = "shared"
+)
+
+// Working directories of a Lua script
+const (
+	// A new empty directory for each run, removed once the script is done
+	WORKDIR_TEMPORARY = "temporary"
+	// A directory kept between the runs of the script
+	WORKDIR_PERSISTENT = "persistent"
+)
+
+// Deduplication keys of a script, other values are the name of the header holding the key
+const (
+	// The ID given to the message by the NATS client
+	DEDUP_KEY_MSG_ID = "Nats-Msg-Id"
+	// A hash of the message's payload
+	DEDUP_KEY_PAYLOAD = "payload"
+)
+
 type Script struct {
-	Content  []byte   `json:"content"`
-	Executor string   `json:"executor"`
-	HTML     bool     `json:"is_html"`
-	LibKeys  []string `json:"libraries"`
-	Name     string   `json:"name"`
-	Subject  string   `json:"subject"`
+	Aggregate    string        `json:"aggregate"`
+	Batch        int           `json:"batch"`
+	BatchWindow  time.Duration `json:"batch_window"`
+	Cache        time.Duration `json:"cache"`
+	CacheHeaders []string      `json:"cache_headers"`
+	CacheScope   string        `json:"cache_scope"`
+	Capabilities []string      `json:"capabilities"`
+	Concurrency  int           `json:"concurrency"`
+	Consumer     string        `json:"consumer"`
+	Content      []byte        `json:"content"`
+	Dedup        time.Duration `json:"dedup"`
+	DedupKey     string        `json:"dedup_key"`
+	DeliverTo    string        `json:"deliver_to"`
+	Delivery     string        `json:"delivery"`
+	Executor     string        `json:"executor"`
+	HTML         bool          `json:"is_html"`
+	LibKeys      []string      `json:"libraries"`
+	Limits       Limits        `json:"limits"`
+	MaxDeliver   int           `json:"max_deliver"`
+	Name         string        `json:"name"`
+	Next         string        `json:"next"`
+	Order        int           `json:"order"`
+	RateLimit    RateLimit     `json:"rate_limit"`
+	Retries      int           `json:"retries"`
+	RetryBackoff time.Duration `json:"retry_backoff"`
+	Schedule     string        `json:"schedule"`
+	Stream       string        `json:"stream"`
+	Subject      string        `json:"subject"`
+	Timeout      time.Duration `json:"timeout"`
+	Workdir      string        `json:"workdir"`
+}
+
+// Exclusive tells if the delivery mode of the script already guarantees that a single
+// instance of the server receives each message
+func (s *Script) Exclusive() bool {
+	return s.Delivery == DELIVERY_QUEUE || s.Delivery == DELIVERY_STREAM || s.Delivery == DELIVERY_SCHEDULE
 }
 
 func ReadFile(filename string) (*Script, error) {
@@ -95,6 +162,105 @@ func (s *Script) Read(f io.Reader) error {
 			}
 		case "executor":
 			s.Executor = v
+		case "delivery":
+			s.Delivery = v
+		case "stream":
+			s.Stream = v
+		case "consumer":
+			s.Consumer = v
+		case "max_deliver":
+			s.MaxDeliver, err = strconv.Atoi(v)
+			if err != nil {
+				s.MaxDeliver = 0
+			}
+		case "aggregate":
+			s.Aggregate = v
+		case "order":
+			s.Order, err = strconv.Atoi(v)
+			if err != nil {
+				s.Order = 0
+			}
+		case "next":
+			s.Next = v
+		case "schedule":
+			s.Schedule = v
+		case "timeout":
+			s.Timeout, err = time.ParseDuration(v)
+			if err != nil {
+				s.Timeout = 0
+			}
+		case "concurrency":
+			s.Concurrency, err = strconv.Atoi(v)
+			if err != nil {
+				s.Concurrency = 0
+			}
+		case "rate_limit":
+			s.RateLimit, err = ParseRateLimit(v)
+			if err != nil {
+				s.RateLimit = RateLimit{}
+			}
+		case "dedup":
+			s.Dedup, err = time.ParseDuration(v)
+			if err != nil {
+				s.Dedup = 0
+			}
+		case "dedup_key":
+			s.DedupKey = v
+		case "batch":
+			s.Batch, err = strconv.Atoi(v)
+			if err != nil {
+				s.Batch = 0
+			}
+		case "batch_window":
+			s.BatchWindow, err = time.ParseDuration(v)
+			if err != nil {
+				s.BatchWindow = 0
+			}
+		case "deliver_to":
+			s.DeliverTo = v
+		case "cache":
+			s.Cache, err = time.ParseDuration(v)
+			if err != nil {
+				s.Cache = 0
+			}
+		case "cache_headers":
+			s.CacheHeaders = SplitList(v)
+		case "capabilities":
+			s.Capabilities = SplitList(v)
+		case "cache_scope":
+			s.CacheScope = v
+		case "max_call_stack":
+			s.Limits.CallStack, err = strconv.Atoi(v)
+			if err != nil {
+				s.Limits.CallStack = 0
+			}
+		case "max_instructions":
+			s.Limits.Instructions, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				s.Limits.Instructions = 0
+			}
+		case "max_memory":
+			s.Limits.Memory, err = ParseSize(v)
+			if err != nil {
+				s.Limits.Memory = 0
+			}
+		case "max_registry":
+			s.Limits.Registry, err = strconv.Atoi(v)
+			if err != nil {
+				s.Limits.Registry = 0
+			}
+		case "workdir":
+			s.Workdir = v
+		case "retries":
+			s.Retries, err = strconv.Atoi(v)
+			if err != nil {
+				s.Retries = 0
+			}
+		case "retry_backoff":
+			s.RetryBackoff, err = time.ParseDuration(v)
+			if err != nil {
+				s.RetryBackoff = 0
+			}
 		default:
 			_, err := b.WriteString(line + "\n")
 			if err != nil {
@@ -108,6 +274,18 @@ func (s *Script) Read(f io.Reader) error {
 	return nil
 }
 
+// SplitList returns the elements of a comma separated list, without the empty ones
+func SplitList(v string) []string {
+	var elems []string
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			elems = append(elems, e)
+		}
+	}
+
+	return elems
+}
+
 func ReadScriptDirectory(dirname string, recurse bool) (map[string]map[string]*Script, error) {
 	scripts := make(map[string]map[string]*Script)
 	if recurse {
@@ -2,6 +2,7 @@ package script
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -17,6 +18,7 @@ end`
 --* name: foo
 --* html: true
 --* require: web
+--* delivery: queue
 `
 	s, err := ReadString(headers + content)
 	assert.Nil(t, err)
@@ -27,6 +29,7 @@ end`
 	assert.Equal(t, true, s.HTML)
 	assert.Equal(t, 1, len(s.LibKeys))
 	assert.Equal(t, "web", s.LibKeys[0])
+	assert.Equal(t, DELIVERY_QUEUE, s.Delivery)
 }
 
 func TestScriptReaderWasmRead(t *testing.T) {
@@ -54,3 +57,116 @@ func TestScriptFileReaderWasmFileRead(t *testing.T) {
 	assert.Equal(t, "funcs.wasm", s.Subject)
 	assert.Contains(t, string(s.Content), "msgscript/examples/wasm/http/http.wasm")
 }
+
+func TestScriptReaderStreamRead(t *testing.T) {
+	content := `--* subject: orders.created
+--* name: orders
+--* stream: ORDERS
+--* consumer: orders-worker
+--* max_deliver: 5
+function OnMessage(_, payload)
+end`
+	s, err := ReadString(content)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "ORDERS", s.Stream)
+	assert.Equal(t, "orders-worker", s.Consumer)
+	assert.Equal(t, 5, s.MaxDeliver)
+}
+
+func TestScriptReaderRetryRead(t *testing.T) {
+	content := `--* subject: orders.created
+--* name: orders
+--* retries: 3
+--* retry_backoff: 2s
+function OnMessage(_, payload)
+end`
+	s, err := ReadString(content)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 3, s.Retries)
+	assert.Equal(t, 2*time.Second, s.RetryBackoff)
+}
+
+func TestScriptReaderRateLimitRead(t *testing.T) {
+	content := `--* subject: api.search
+--* name: search
+--* rate_limit: 10/s burst 20
+function OnMessage(_, payload)
+end`
+	s, err := ReadString(content)
+	assert.Nil(t, err)
+
+	assert.Equal(t, RateLimit{Rate: 10, Per: time.Second, Burst: 20}, s.RateLimit)
+
+	rl, err := ParseRateLimit("100/5m")
+	assert.Nil(t, err)
+	assert.Equal(t, RateLimit{Rate: 100, Per: 5 * time.Minute, Burst: 100}, rl)
+
+	for _, spec := range []string{"10", "0/s", "10/x", "10/s 20", "10/s burst 0"} {
+		_, err = ParseRateLimit(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestScriptReaderLimitsRead(t *testing.T) {
+	s, err := ReadString(`--* subject: funcs.foobar
+--* name: foo
+--* max_call_stack: 100
+--* max_instructions: 1000000
+--* max_memory: 64MB
+--* max_registry: 10000
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, Limits{CallStack: 100, Instructions: 1000000, Memory: 64 << 20, Registry: 10000}, s.Limits)
+
+	// The server's limits apply when they are lower or unset in the script
+	server := Limits{CallStack: 50, Memory: 128 << 20, Registry: 20000}
+	assert.Equal(t, Limits{CallStack: 50, Instructions: 1000000, Memory: 64 << 20, Registry: 10000}, s.Limits.Within(server))
+	assert.Equal(t, server, Limits{}.Within(server))
+
+	for spec, size := range map[string]int64{"512": 512, "4k": 4 << 10, "2 GB": 2 << 30} {
+		n, err := ParseSize(spec)
+		assert.Nil(t, err, spec)
+		assert.Equal(t, size, n, spec)
+	}
+	_, err = ParseSize("lots")
+	assert.NotNil(t, err)
+}
+
+func TestScriptReaderHeadersRead(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  string
+		expected Script
+	}{
+		{"dedup", "--* dedup: 10m\n--* dedup_key: Idempotency-Key", Script{Dedup: 10 * time.Minute, DedupKey: "Idempotency-Key"}},
+		{"dedup invalid", "--* dedup: soon", Script{}},
+		{"batch", "--* batch: 100\n--* batch_window: 5s", Script{Batch: 100, BatchWindow: 5 * time.Second}},
+		{"batch invalid", "--* batch: many\n--* batch_window: later", Script{}},
+		{"cache", "--* cache: 1m\n--* cache_headers: Accept, Accept-Language\n--* cache_scope: shared", Script{Cache: time.Minute, CacheHeaders: []string{"Accept", "Accept-Language"}, CacheScope: CACHE_SCOPE_SHARED}},
+		{"cache invalid", "--* cache: forever", Script{}},
+		{"capabilities", "--* capabilities: http, json,nats", Script{Capabilities: []string{"http", "json", "nats"}}},
+		{"timeout", "--* timeout: 30s", Script{Timeout: 30 * time.Second}},
+		{"timeout invalid", "--* timeout: soon", Script{}},
+		{"concurrency", "--* concurrency: 4", Script{Concurrency: 4}},
+		{"concurrency invalid", "--* concurrency: some", Script{}},
+		{"workdir", "--* workdir: /var/lib/scripts", Script{Workdir: "/var/lib/scripts"}},
+		{"order", "--* order: -10", Script{Order: -10}},
+		{"order invalid", "--* order: first", Script{}},
+		{"next", "--* next: orders.enrich", Script{Next: "orders.enrich"}},
+		{"aggregate", "--* aggregate: merge", Script{Aggregate: "merge"}},
+		{"deliver_to", "--* deliver_to: https://example.com/hook", Script{DeliverTo: "https://example.com/hook"}},
+	}
+
+	for _, tt := range tests {
+		s, err := ReadString("--* subject: funcs.foobar\n--* name: foo\n" + tt.headers + "\nfunction OnMessage(_, payload)\nend")
+		assert.Nil(t, err, tt.name)
+		assert.Equal(t, "function OnMessage(_, payload)\nend", string(s.Content), tt.name)
+
+		tt.expected.Subject = "funcs.foobar"
+		tt.expected.Name = "foo"
+		tt.expected.Content = s.Content
+		assert.Equal(t, tt.expected, *s, tt.name)
+	}
+}
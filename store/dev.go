@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/numkem/msgscript/script"
 	log "github.com/sirupsen/logrus"
@@ -19,6 +20,7 @@ type DevStore struct {
 	// Value: content
 	scripts   map[string]map[string]*script.Script
 	libraries map[string][]byte
+	values    *memoryValues
 }
 
 const DEV_BACKEND_NAME = "dev"
@@ -27,6 +29,7 @@ func NewDevStore(libraryPath string) (ScriptStore, error) {
 	store := &DevStore{
 		scripts:   make(map[string]map[string]*script.Script),
 		libraries: make(map[string][]byte),
+		values:    newMemoryValues(),
 	}
 
 	if libraryPath != "" {
@@ -141,6 +144,24 @@ func (s *DevStore) RemoveLibrary(ctx context.Context, path string) error {
 	return nil
 }
 
+func (s *DevStore) SetValue(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.values.set(key, value, ttl)
+	return nil
+}
+
+func (s *DevStore) GetValue(ctx context.Context, key string) ([]byte, error) {
+	return s.values.get(key), nil
+}
+
+func (s *DevStore) DeleteValue(ctx context.Context, key string) error {
+	s.values.delete(key)
+	return nil
+}
+
+func (s *DevStore) UpdateValue(ctx context.Context, key string, ttl time.Duration, update func(value []byte) ([]byte, error)) error {
+	return s.values.update(key, ttl, update)
+}
+
 func (s *DevStore) BackendName() string {
 	return DEV_BACKEND_NAME
 }
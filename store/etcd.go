@@ -20,6 +20,7 @@ const (
 	ETCD_SESSION_TTL        = 3 // In seconds
 	ETCD_SCRIPT_KEY_PREFIX  = "msgscript/scripts"
 	ETCD_LIBRARY_KEY_PREFIX = "msgscript/libs"
+	ETCD_VALUE_KEY_PREFIX   = "msgscript/values"
 	ETCD_BACKEND_NAME       = "etcd"
 )
 
@@ -28,6 +29,7 @@ type EtcdScriptStore struct {
 	client  *clientv3.Client
 	prefix  string
 	mutexes sync.Map
+	leases  *etcdLeases
 }
 
 func EtcdClient(endpoints string) (*clientv3.Client, error) {
@@ -69,6 +71,7 @@ func NewEtcdScriptStore(endpoints string) (ScriptStore, error) {
 		client:  client,
 		prefix:  ETCD_SCRIPT_KEY_PREFIX,
 		mutexes: sync.Map{},
+		leases:  newEtcdLeases(client),
 	}, nil
 }
 
@@ -117,7 +120,8 @@ func encodeValue(scr *script.Script) ([]byte, error) {
 
 // GetScripts retrieves all scripts associated with a subject
 func (e *EtcdScriptStore) GetScripts(ctx context.Context, subject string) (map[string]*script.Script, error) {
-	keyPrefix := strings.Join([]string{e.prefix, subject}, "/")
+	// The trailing separator prevents from also fetching subjects sharing the same prefix
+	keyPrefix := strings.Join([]string{e.prefix, subject, ""}, "/")
 
 	// Fetch all scripts under the subject's prefix
 	resp, err := e.client.Get(ctx, keyPrefix, clientv3.WithPrefix())
@@ -153,15 +157,25 @@ func (e *EtcdScriptStore) DeleteScript(ctx context.Context, subject, name string
 	return nil
 }
 
-// WatchScripts watches for changes to scripts for a specific subject
+// WatchScripts watches for changes to scripts for a specific subject.
+// An empty subject watches the scripts of all the subjects.
 func (e *EtcdScriptStore) WatchScripts(ctx context.Context, subject string, onChange func(subject, name string, script []byte, deleted bool)) {
-	keyPrefix := fmt.Sprintf("%s/%s/", e.prefix, subject)
+	keyPrefix := e.prefix + "/"
+	if subject != "" {
+		keyPrefix = fmt.Sprintf("%s/%s/", e.prefix, subject)
+	}
 
 	watchChan := e.client.Watch(ctx, keyPrefix, clientv3.WithPrefix())
 
 	for watchResp := range watchChan {
 		for _, ev := range watchResp.Events {
-			name := string(ev.Kv.Key[len(keyPrefix):])
+			// Keys are in the form of <prefix>/<subject>/<name>
+			ss := strings.SplitN(strings.TrimPrefix(string(ev.Kv.Key), e.prefix+"/"), "/", 2)
+			if len(ss) != 2 {
+				continue
+			}
+			subject, name := ss[0], ss[1]
+
 			switch ev.Type {
 			case clientv3.EventTypePut:
 				log.Debugf("Script added/updated for subject: %s, ID: %s", subject, name)
@@ -235,7 +249,7 @@ func (e *EtcdScriptStore) TakeLock(ctx context.Context, path string) (bool, erro
 	mu, err := e.acquireLock(ctx, lockKey, ETCD_SESSION_TTL)
 	if err != nil {
 		if err == concurrency.ErrLocked {
-			return false, fmt.Errorf("already locked")
+			return false, nil
 		}
 
 		return false, fmt.Errorf("failed to get lock on key %s: %w", lockKey, err)
@@ -244,7 +258,7 @@ func (e *EtcdScriptStore) TakeLock(ctx context.Context, path string) (bool, erro
 	// Remove the mutex from the map after 1 second more than the session's TTL in case it's never unlocked
 	timer := time.AfterFunc((ETCD_SESSION_TTL+1)*time.Second, func() {
 		log.WithField("path", path).Debug("Releasing lock on timeout")
-		e.ReleaseLock(context.Background(), lockKey)
+		e.ReleaseLock(context.Background(), path)
 	})
 
 	e.mutexes.Store(path, &lock{
@@ -310,6 +324,97 @@ func (e *EtcdScriptStore) RemoveLibrary(ctx context.Context, path string) error
 	return nil
 }
 
+func etcdValueKey(key string) string {
+	return strings.Join([]string{ETCD_VALUE_KEY_PREFIX, key}, "/")
+}
+
+// SetValue stores the value with a lease so etcd removes it once the TTL expires
+func (e *EtcdScriptStore) SetValue(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	var opts []clientv3.OpOption
+	if ttl > 0 {
+		lease, err := e.leases.get(ctx, ttl)
+		if err != nil {
+			return fmt.Errorf("failed to create lease for value %s: %w", key, err)
+		}
+		opts = append(opts, clientv3.WithLease(lease))
+	}
+
+	_, err := e.client.KV.Put(ctx, etcdValueKey(key), string(value), opts...)
+	if err != nil {
+		return fmt.Errorf("failed to put value %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (e *EtcdScriptStore) GetValue(ctx context.Context, key string) ([]byte, error) {
+	resp, err := e.client.KV.Get(ctx, etcdValueKey(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get value %s: %w", key, err)
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	return resp.Kvs[0].Value, nil
+}
+
+func (e *EtcdScriptStore) DeleteValue(ctx context.Context, key string) error {
+	_, err := e.client.KV.Delete(ctx, etcdValueKey(key))
+	if err != nil {
+		return fmt.Errorf("failed to delete value %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (e *EtcdScriptStore) UpdateValue(ctx context.Context, key string, ttl time.Duration, update func(value []byte) ([]byte, error)) error {
+	k := etcdValueKey(key)
+
+	var opts []clientv3.OpOption
+	if ttl > 0 {
+		lease, err := e.leases.get(ctx, ttl)
+		if err != nil {
+			return fmt.Errorf("failed to create lease for value %s: %w", key, err)
+		}
+		opts = append(opts, clientv3.WithLease(lease))
+	}
+
+	for {
+		resp, err := e.client.KV.Get(ctx, k)
+		if err != nil {
+			return fmt.Errorf("failed to get value %s: %w", key, err)
+		}
+
+		// A missing key has a revision of 0
+		var old []byte
+		var rev int64
+		if len(resp.Kvs) > 0 {
+			old = resp.Kvs[0].Value
+			rev = resp.Kvs[0].ModRevision
+		}
+
+		value, err := update(old)
+		if err != nil {
+			return err
+		}
+
+		// Only write the value if nobody changed it since it was read
+		txn, err := e.client.KV.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(k), "=", rev)).
+			Then(clientv3.OpPut(k, string(value), opts...)).
+			Commit()
+		if err != nil {
+			return fmt.Errorf("failed to update value %s: %w", key, err)
+		}
+
+		if txn.Succeeded {
+			return nil
+		}
+	}
+}
+
 func (e *EtcdScriptStore) BackendName() string {
 	return ETCD_BACKEND_NAME
 }
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdLease is a lease granted for the values with the same TTL
+type etcdLease struct {
+	id      clientv3.LeaseID
+	expires time.Time
+}
+
+// etcdLeases hands out the leases of the values so a lease isn't granted for each write. A lease is granted for
+// a tenth longer than the TTL and shared until the values written with it would outlive it, so the values expire
+// between their TTL and a tenth of it later. Etcd removes the leases once they expire.
+type etcdLeases struct {
+	mu     sync.Mutex
+	client *clientv3.Client
+	leases map[int64]*etcdLease // By TTL in seconds
+}
+
+func newEtcdLeases(client *clientv3.Client) *etcdLeases {
+	return &etcdLeases{
+		client: client,
+		leases: make(map[int64]*etcdLease),
+	}
+}
+
+// get returns a lease keeping a value for at least the TTL
+func (l *etcdLeases) get(ctx context.Context, ttl time.Duration) (clientv3.LeaseID, error) {
+	// Leases have a granularity of a second
+	seconds := max(int64(math.Ceil(ttl.Seconds())), 1)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if lease, found := l.leases[seconds]; found && now.Add(time.Duration(seconds)*time.Second).Before(lease.expires) {
+		return lease.id, nil
+	}
+
+	granted := seconds + max(seconds/10, 1)
+	resp, err := l.client.Grant(ctx, granted)
+	if err != nil {
+		return 0, err
+	}
+	l.leases[seconds] = &etcdLease{id: resp.ID, expires: now.Add(time.Duration(granted) * time.Second)}
+
+	return resp.ID, nil
+}
@@ -3,8 +3,12 @@ package store
 import (
 	"context"
 	"fmt"
+	"maps"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
@@ -16,6 +20,18 @@ type FileScriptStore struct {
 	filePath string
 	scripts  *sync.Map
 	libs     *sync.Map
+	values   *memoryValues
+
+	mu           sync.Mutex
+	watchers     map[int]fileWatcher
+	nextWatcher  int
+	stopWatching context.CancelFunc // Stops the fsnotify watcher, nil when it isn't running
+}
+
+// fileWatcher is a caller of WatchScripts, subject is empty to receive the changes of all the subjects
+type fileWatcher struct {
+	subject  string
+	onChange func(subject, path string, script []byte, deleted bool)
 }
 
 type fileStoreMapValue map[string]*script.Script
@@ -24,8 +40,11 @@ const FILE_BACKEND_NAME = "file"
 
 func NewFileScriptStore(scriptPath string, libraryPath string) (ScriptStore, error) {
 	return &FileScriptStore{
-		scripts: new(sync.Map),
-		libs:    new(sync.Map),
+		filePath: scriptPath,
+		scripts:  new(sync.Map),
+		libs:     new(sync.Map),
+		values:   newMemoryValues(),
+		watchers: make(map[int]fileWatcher),
 	}, nil
 }
 
@@ -41,13 +60,14 @@ func (f *FileScriptStore) GetScripts(ctx context.Context, subject string) (map[s
 }
 
 func (f *FileScriptStore) AddScript(ctx context.Context, subject, name string, scr *script.Script) error {
-	sl, ok := f.scripts.Load(subject)
-	if !ok {
-		f.scripts.Store(subject, make(fileStoreMapValue))
-		sl, _ = f.scripts.Load(subject)
+	// The maps are copied on write since they can be read by running handlers
+	scrm := make(fileStoreMapValue)
+	if sl, ok := f.scripts.Load(subject); ok {
+		for n, s := range sl.(fileStoreMapValue) {
+			scrm[n] = s
+		}
 	}
 
-	scrm := sl.(fileStoreMapValue)
 	scrm[name] = scr
 	f.scripts.Store(subject, scrm)
 
@@ -60,8 +80,12 @@ func (f *FileScriptStore) DeleteScript(ctx context.Context, subject, name string
 		return nil
 	}
 
-	scrm := sl.(fileStoreMapValue)
-	delete(scrm, name)
+	scrm := make(fileStoreMapValue)
+	for n, s := range sl.(fileStoreMapValue) {
+		if n != name {
+			scrm[n] = s
+		}
+	}
 
 	f.scripts.Store(subject, scrm)
 	return nil
@@ -75,21 +99,48 @@ func (f *FileScriptStore) TakeLock(ctx context.Context, path string) (bool, erro
 	return true, nil
 }
 
-// WatchScripts uses fsnotify to monitor the script file for changes
+// WatchScripts calls onChange for each script added, modified or removed from the script directory, the store is
+// updated before onChange is called. A single fsnotify watcher is shared by all the callers, it runs until the
+// context of the last one is cancelled.
 func (f *FileScriptStore) WatchScripts(ctx context.Context, subject string, onChange func(subject, path string, script []byte, deleted bool)) {
+	f.mu.Lock()
+	id := f.nextWatcher
+	f.nextWatcher++
+	f.watchers[id] = fileWatcher{subject: subject, onChange: onChange}
+	if f.stopWatching == nil {
+		var watchCtx context.Context
+		watchCtx, f.stopWatching = context.WithCancel(context.Background())
+		go f.watch(watchCtx)
+	}
+	f.mu.Unlock()
+
+	<-ctx.Done()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.watchers, id)
+	if len(f.watchers) == 0 {
+		f.stopWatching()
+		f.stopWatching = nil
+	}
+}
+
+// watch uses fsnotify to monitor the script directory for changes
+func (f *FileScriptStore) watch(ctx context.Context) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatalf("failed to create watcher: %v", err)
 	}
 	defer watcher.Close()
 
-	// Add the file to the watcher
+	// Add the directory to the watcher
 	err = watcher.Add(f.filePath)
 	if err != nil {
-		log.Fatalf("failed to add file to watcher: %v", err)
+		log.Fatalf("failed to add directory to watcher: %v", err)
 	}
 
-	log.Infof("Started watching file: %s", f.filePath)
+	log.Infof("Started watching directory: %s", f.filePath)
 
 	for {
 		select {
@@ -98,17 +149,16 @@ func (f *FileScriptStore) WatchScripts(ctx context.Context, subject string, onCh
 				return
 			}
 
-			// We only care about write events, which means the file has been modified
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				log.Infof("File modified: %s", f.filePath)
+			if filepath.Ext(event.Name) != ".lua" || event.Op == fsnotify.Chmod {
+				continue
+			}
 
-				scr, err := script.ReadFile(filepath.Join(f.filePath, event.Name))
-				if err != nil {
-					log.Errorf("failed to read script file %s: %v", f.filePath, err)
-				}
+			log.Infof("File modified: %s", event.Name)
 
-				// Trigger the onChange callback for each script
-				onChange(scr.Subject, f.filePath, scr.Content, false)
+			// Files can be renamed or removed so it's easier to reload the whole directory
+			err := f.reload(ctx)
+			if err != nil {
+				log.Errorf("failed to reload script directory %s: %v", f.filePath, err)
 			}
 
 		case err, ok := <-watcher.Errors:
@@ -124,6 +174,81 @@ func (f *FileScriptStore) WatchScripts(ctx context.Context, subject string, onCh
 	}
 }
 
+// fileScriptChange is a script added, modified or removed from the script directory
+type fileScriptChange struct {
+	subject string
+	name    string
+	script  *script.Script // nil when the script was removed
+}
+
+// reload reads the script directory again, synchronizes the store with its content and tells the watchers about
+// the scripts that changed
+func (f *FileScriptStore) reload(ctx context.Context) error {
+	allScripts, err := script.ReadScriptDirectory(f.filePath, false)
+	if err != nil {
+		return fmt.Errorf("failed to read scripts: %w", err)
+	}
+
+	// Remove the scripts that aren't on disk anymore
+	var changes []fileScriptChange
+	f.scripts.Range(func(key, value any) bool {
+		subject := key.(string)
+		for name := range value.(fileStoreMapValue) {
+			if _, found := allScripts[subject][name]; !found {
+				f.DeleteScript(ctx, subject, name)
+				changes = append(changes, fileScriptChange{subject: subject, name: name})
+			}
+		}
+
+		return true
+	})
+
+	for subject, namedScripts := range allScripts {
+		if subject == "" {
+			continue
+		}
+
+		for name, scr := range namedScripts {
+			if old, found := f.script(subject, name); found && reflect.DeepEqual(old, scr) {
+				continue
+			}
+
+			f.AddScript(ctx, subject, name, scr)
+			changes = append(changes, fileScriptChange{subject: subject, name: name, script: scr})
+		}
+	}
+
+	f.mu.Lock()
+	watchers := slices.Collect(maps.Values(f.watchers))
+	f.mu.Unlock()
+
+	for _, change := range changes {
+		for _, w := range watchers {
+			if w.subject != "" && w.subject != change.subject {
+				continue
+			}
+
+			if change.script == nil {
+				w.onChange(change.subject, change.name, nil, true)
+			} else {
+				w.onChange(change.subject, change.name, change.script.Content, false)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *FileScriptStore) script(subject, name string) (*script.Script, bool) {
+	sl, ok := f.scripts.Load(subject)
+	if !ok {
+		return nil, false
+	}
+
+	scr, found := sl.(fileStoreMapValue)[name]
+	return scr, found
+}
+
 func (f *FileScriptStore) ListSubjects(ctx context.Context) ([]string, error) {
 	var subjects []string
 
@@ -159,6 +284,25 @@ func (f *FileScriptStore) RemoveLibrary(ctx context.Context, path string) error
 	return nil
 }
 
+// Values are kept in memory since they don't belong in the script directory
+func (f *FileScriptStore) SetValue(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	f.values.set(key, value, ttl)
+	return nil
+}
+
+func (f *FileScriptStore) GetValue(ctx context.Context, key string) ([]byte, error) {
+	return f.values.get(key), nil
+}
+
+func (f *FileScriptStore) DeleteValue(ctx context.Context, key string) error {
+	f.values.delete(key)
+	return nil
+}
+
+func (f *FileScriptStore) UpdateValue(ctx context.Context, key string, ttl time.Duration, update func(value []byte) ([]byte, error)) error {
+	return f.values.update(key, ttl, update)
+}
+
 func (f *FileScriptStore) BackendName() string {
 	return FILE_BACKEND_NAME
 }
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fileChange struct {
+	subject string
+	name    string
+	deleted bool
+}
+
+func TestFileScriptStoreWatchScripts(t *testing.T) {
+	dir := t.TempDir()
+	writeScript := func(filename, subject, content string) {
+		err := os.WriteFile(filepath.Join(dir, filename), []byte("--* subject: "+subject+"\n--* name: "+filename+"\n"+content), 0o644)
+		assert.NoError(t, err)
+	}
+	writeScript("a.lua", "foo", "return 1")
+	writeScript("b.lua", "bar", "return 2")
+
+	s, err := StoreByName(BACKEND_FILE_NAME, "", dir, "")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Every caller receives the changes, they are only told about the scripts that changed
+	watch := func(subject string) chan fileChange {
+		changes := make(chan fileChange, 10)
+		go s.WatchScripts(ctx, subject, func(subject, name string, _ []byte, deleted bool) {
+			changes <- fileChange{subject: subject, name: name, deleted: deleted}
+		})
+		return changes
+	}
+	all, other := watch(""), watch("other")
+	first := watch("")
+	time.Sleep(100 * time.Millisecond)
+
+	next := func(changes chan fileChange) fileChange {
+		select {
+		case change := <-changes:
+			return change
+		case <-time.After(2 * time.Second):
+			t.Fatal("no change received")
+			return fileChange{}
+		}
+	}
+
+	writeScript("a.lua", "foo", "return 3")
+	assert.Equal(t, fileChange{subject: "foo", name: "a.lua"}, next(first))
+	assert.Equal(t, fileChange{subject: "foo", name: "a.lua"}, next(all))
+
+	assert.NoError(t, os.Remove(filepath.Join(dir, "b.lua")))
+	assert.Equal(t, fileChange{subject: "bar", name: "b.lua", deleted: true}, next(first))
+	assert.Equal(t, fileChange{subject: "bar", name: "b.lua", deleted: true}, next(all))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, first)
+	assert.Empty(t, all)
+	assert.Empty(t, other)
+
+	scripts, err := s.GetScripts(ctx, "bar")
+	assert.NoError(t, err)
+	assert.Empty(t, scripts)
+}
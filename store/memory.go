@@ -0,0 +1,98 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// How often the expired values are removed from memory
+const MEMORY_VALUES_SWEEP_INTERVAL = time.Minute
+
+type memoryValue struct {
+	value   []byte
+	expires time.Time
+}
+
+func (v *memoryValue) expired(now time.Time) bool {
+	return !v.expires.IsZero() && now.After(v.expires)
+}
+
+// memoryValues keeps values in memory for the stores that don't have a place to persist them
+type memoryValues struct {
+	mu        sync.Mutex
+	values    map[string]*memoryValue
+	lastSweep time.Time
+}
+
+func newMemoryValues() *memoryValues {
+	return &memoryValues{
+		values: make(map[string]*memoryValue),
+	}
+}
+
+func (m *memoryValues) set(key string, value []byte, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.setLocked(key, value, ttl)
+}
+
+func (m *memoryValues) setLocked(key string, value []byte, ttl time.Duration) {
+	// Expired values are removed when read, the ones never read again are swept once in a while
+	now := time.Now()
+	if now.Sub(m.lastSweep) >= MEMORY_VALUES_SWEEP_INTERVAL {
+		for k, v := range m.values {
+			if v.expired(now) {
+				delete(m.values, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	v := &memoryValue{value: value}
+	if ttl > 0 {
+		v.expires = now.Add(ttl)
+	}
+	m.values[key] = v
+}
+
+func (m *memoryValues) get(key string) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.getLocked(key)
+}
+
+func (m *memoryValues) getLocked(key string) []byte {
+	v, found := m.values[key]
+	if !found {
+		return nil
+	}
+	if v.expired(time.Now()) {
+		delete(m.values, key)
+		return nil
+	}
+
+	return v.value
+}
+
+func (m *memoryValues) delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.values, key)
+}
+
+// update replaces the value by the one returned by the function, without any other change happening in between
+func (m *memoryValues) update(key string, ttl time.Duration, update func(value []byte) ([]byte, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, err := update(m.getLocked(key))
+	if err != nil {
+		return err
+	}
+
+	m.setLocked(key, value, ttl)
+	return nil
+}
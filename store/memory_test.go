@@ -0,0 +1,56 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryValues(t *testing.T) {
+	m := newMemoryValues()
+
+	m.set("kept", []byte("value"), 0)
+	m.set("expired", []byte("value"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	assert.Equal(t, []byte("value"), m.get("kept"))
+	assert.Nil(t, m.get("expired"))
+	assert.Nil(t, m.get("missing"))
+
+	m.delete("kept")
+	assert.Nil(t, m.get("kept"))
+
+	// Reading an expired value removes it
+	assert.Empty(t, m.values)
+}
+
+func TestMemoryValuesSweep(t *testing.T) {
+	m := newMemoryValues()
+	m.set("unread", []byte("value"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	// The values that expired without being read are removed on the first write after the sweep interval
+	m.set("other", []byte("value"), 0)
+	assert.Contains(t, m.values, "unread")
+
+	m.lastSweep = time.Now().Add(-MEMORY_VALUES_SWEEP_INTERVAL)
+	m.set("other", []byte("value"), 0)
+	assert.NotContains(t, m.values, "unread")
+}
+
+func TestMemoryValuesUpdate(t *testing.T) {
+	m := newMemoryValues()
+
+	increment := func(value []byte) ([]byte, error) {
+		return append(value, 'x'), nil
+	}
+	assert.Nil(t, m.update("counter", 0, increment))
+	assert.Nil(t, m.update("counter", 0, increment))
+	assert.Equal(t, []byte("xx"), m.get("counter"))
+
+	assert.NotNil(t, m.update("counter", 0, func([]byte) ([]byte, error) {
+		return nil, assert.AnError
+	}))
+	assert.Equal(t, []byte("xx"), m.get("counter"))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -28,6 +29,14 @@ type ScriptStore interface {
 	LoadLibrairies(ctx context.Context, libraryPaths []string) ([][]byte, error)
 	AddLibrary(ctx context.Context, content []byte, path string) error
 	RemoveLibrary(ctx context.Context, path string) error
+	// SetValue stores a value that expires after the TTL, a TTL of 0 never expires
+	SetValue(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// GetValue returns nil when the value doesn't exist or expired
+	GetValue(ctx context.Context, key string) ([]byte, error)
+	DeleteValue(ctx context.Context, key string) error
+	// UpdateValue atomically replaces the value by the one returned by the update function, which receives nil
+	// when the value doesn't exist. The function can be called multiple times if the value changes concurrently.
+	UpdateValue(ctx context.Context, key string, ttl time.Duration, update func(value []byte) ([]byte, error)) error
 	BackendName() string
 }
 
@@ -0,0 +1,40 @@
+package store
+
+import (
+	"strings"
+)
+
+const (
+	SUBJECT_TOKEN_SEPARATOR = "."
+	SUBJECT_WILDCARD_SINGLE = "*"
+	SUBJECT_WILDCARD_FULL   = ">"
+)
+
+// SubjectMatches tells if a concrete subject matches a pattern using the NATS token semantics:
+// `*` matches exactly one token and `>` matches one or more tokens at the end of the subject
+func SubjectMatches(pattern, subject string) bool {
+	if pattern == subject {
+		return true
+	}
+
+	pts := strings.Split(pattern, SUBJECT_TOKEN_SEPARATOR)
+	sts := strings.Split(subject, SUBJECT_TOKEN_SEPARATOR)
+
+	for i, pt := range pts {
+		switch pt {
+		case SUBJECT_WILDCARD_FULL:
+			// Only valid as the last token and needs at least one token to match
+			return i == len(pts)-1 && len(sts) > i
+		case SUBJECT_WILDCARD_SINGLE:
+			if i >= len(sts) || sts[i] == "" {
+				return false
+			}
+		default:
+			if i >= len(sts) || sts[i] != pt {
+				return false
+			}
+		}
+	}
+
+	return len(pts) == len(sts)
+}
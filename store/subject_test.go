@@ -0,0 +1,31 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubjectMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		subject string
+		matches bool
+	}{
+		{"funcs.hello", "funcs.hello", true},
+		{"funcs.hello", "funcs.hello.world", false},
+		{"events.orders.*", "events.orders.created", true},
+		{"events.orders.*", "events.orders", false},
+		{"events.orders.*", "events.orders.created.eu", false},
+		{"events.*.created", "events.orders.created", true},
+		{"audit.>", "audit.login", true},
+		{"audit.>", "audit.login.failed", true},
+		{"audit.>", "audit", false},
+		{">", "anything.at.all", true},
+		{"audit.>.failed", "audit.login.failed", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.matches, SubjectMatches(tt.pattern, tt.subject), "pattern %s with subject %s", tt.pattern, tt.subject)
+	}
+}